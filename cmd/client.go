@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xbt573/barkpaste/internal/envelope"
+)
+
+var client struct {
+	Server       string
+	Auth         string
+	ExpiresAfter time.Duration
+	BurnAfter    bool
+	MaxViews     uint
+	Password     string
+	Visibility   string
+}
+
+func init() {
+	sendCmd.Flags().StringVar(&client.Server, "server", "http://127.0.0.1:8888", "Server URL")
+	sendCmd.Flags().StringVar(&client.Auth, "auth", "", "Token to create paste with (anonymous if empty)")
+	sendCmd.Flags().DurationVar(&client.ExpiresAfter, "expires-after", 0, "TTL of paste (server default if 0)")
+	sendCmd.Flags().BoolVar(&client.BurnAfter, "burn", false, "Delete paste after the first read")
+	sendCmd.Flags().UintVar(&client.MaxViews, "max-views", 0, "Delete paste after that many reads (unlimited if 0)")
+	sendCmd.Flags().StringVar(&client.Password, "password", "", "Password needed to read paste")
+	sendCmd.Flags().StringVar(&client.Visibility, "visibility", "", "One of public unlisted private (server default if empty)")
+	fetchCmd.Flags().StringVar(&client.Password, "password", "", "Password of paste")
+	fetchCmd.Flags().StringVar(&client.Auth, "auth", "", "Token to read private paste with")
+
+	rootCmd.AddCommand(sendCmd)
+	rootCmd.AddCommand(fetchCmd)
+}
+
+// key is only ever in the printed link, server gets ciphertext
+var sendCmd = &cobra.Command{
+	Use:   "send [file]",
+	Short: "Encrypt file (or stdin) locally and paste it",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var (
+			content []byte
+			err     error
+		)
+
+		if len(args) == 1 {
+			content, err = os.ReadFile(args[0])
+		} else {
+			content, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return err
+		}
+
+		sealed, key, err := envelope.Seal(content)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(client.Server, "/")+"/", bytes.NewReader(sealed))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("X-Encrypted", "true")
+		req.Header.Set("Content-Type", "application/json")
+
+		if client.Auth != "" {
+			req.Header.Set("Authorization", "Bearer "+client.Auth)
+		}
+
+		if client.ExpiresAfter > 0 {
+			req.Header.Set("X-Expires-After", strconv.Itoa(int(client.ExpiresAfter.Seconds())))
+		}
+
+		if client.BurnAfter {
+			req.Header.Set("X-Burn-After-Read", "true")
+		}
+
+		if client.MaxViews > 0 {
+			req.Header.Set("X-Max-Views", strconv.FormatUint(uint64(client.MaxViews), 10))
+		}
+
+		if client.Password != "" {
+			req.Header.Set("X-Password", client.Password)
+		}
+
+		if client.Visibility != "" {
+			req.Header.Set("X-Visibility", client.Visibility)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusCreated {
+			return fmt.Errorf("server said %v: %s", res.Status, bytes.TrimSpace(body))
+		}
+
+		fmt.Printf("%s#%v\n", bytes.TrimSpace(body), key)
+
+		if deleteKey := res.Header.Get("X-Delete-Key"); deleteKey != "" {
+			fmt.Fprintf(os.Stderr, "delete key: %v\n", deleteKey)
+		}
+
+		return nil
+	},
+}
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch <url#key>",
+	Short: "Fetch encrypted paste and decrypt it locally",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		u, err := url.Parse(args[0])
+		if err != nil {
+			return err
+		}
+
+		key := u.Fragment
+		if key == "" {
+			return fmt.Errorf("no key in url, it goes after #")
+		}
+
+		u.Fragment = ""
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Accept", "application/octet-stream")
+
+		if client.Password != "" {
+			req.Header.Set("X-Password", client.Password)
+		}
+
+		if client.Auth != "" {
+			req.Header.Set("Authorization", "Bearer "+client.Auth)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("server said %v", res.Status)
+		}
+
+		sealed, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		content, err := envelope.Open(sealed, key)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(content)
+		return err
+	},
+}
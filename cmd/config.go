@@ -3,9 +3,10 @@ package cmd
 import "time"
 
 type Config struct {
-	Listen   string   `mapstructure:"listen"`
-	Database Database `mapstructure:"database"`
-	Settings Settings `mapstructure:"settings"`
+	Listen     string     `mapstructure:"listen"`
+	Database   Database   `mapstructure:"database"`
+	Settings   Settings   `mapstructure:"settings"`
+	Encryption Encryption `mapstructure:"encryption"`
 }
 
 type Settings struct {
@@ -13,11 +14,48 @@ type Settings struct {
 	Limit     uint          `mapstructure:"limit"`
 	BodyLimit uint          `mapstructure:"bodylimit"`
 	Token     string        `mapstructure:"token"`
+	Pepper    string        `mapstructure:"pepper"`
+	// signs share links, random when empty, so links die on restart
+	ShareSecret string `mapstructure:"sharesecret"`
+
+	CompressThreshold int `mapstructure:"compressthreshold"`
+	// active content types like text/html served as they are, see controller
+	AllowedTypes []string `mapstructure:"allowedtypes"`
+
+	CleanInterval  time.Duration `mapstructure:"cleaninterval"`
+	CleanBatch     int           `mapstructure:"cleanbatch"`
+	CleanJitter    time.Duration `mapstructure:"cleanjitter"`
+	OrphanInterval time.Duration `mapstructure:"orphaninterval"`
 }
 
 type Database struct {
-	Type DatabaseType `mapstructure:"type"`
-	URI  string       `mapstructure:"uri"`
+	Type    DatabaseType `mapstructure:"type"`
+	URI     string       `mapstructure:"uri"`
+	Storage Storage      `mapstructure:"storage"`
+}
+
+// Storage is where paste contents go, database only keeps metadata
+type Storage struct {
+	Type StorageType `mapstructure:"type"`
+	Path string      `mapstructure:"path"`
+
+	Endpoint  string `mapstructure:"endpoint"`
+	Bucket    string `mapstructure:"bucket"`
+	Region    string `mapstructure:"region"`
+	AccessKey string `mapstructure:"accesskey"`
+	SecretKey string `mapstructure:"secretkey"`
+	PathStyle bool   `mapstructure:"pathstyle"`
+	Prefix    string `mapstructure:"prefix"`
+}
+
+// Encryption of paste contents at rest, master keys never reach the database
+type Encryption struct {
+	// ID of the master key for new content, empty stores it unencrypted
+	Key string `mapstructure:"key"`
+	// master key ID to base64 of 32 bytes, old keys are kept to decrypt
+	Keys map[string]string `mapstructure:"keys"`
+	// file with "id base64" lines, merged into Keys
+	KeyFile string `mapstructure:"keyfile"`
 }
 
 type DatabaseType string
@@ -26,3 +64,10 @@ const (
 	PostgreSQL DatabaseType = "postgresql"
 	SQLite     DatabaseType = "sqlite"
 )
+
+type StorageType string
+
+const (
+	Local StorageType = "local"
+	S3    StorageType = "s3"
+)
@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"os/signal"
 	"time"
@@ -12,6 +14,9 @@ import (
 	"github.com/spf13/viper"
 	"github.com/xbt573/barkpaste/internal/app"
 	pasteController "github.com/xbt573/barkpaste/internal/controller/paste"
+	"github.com/xbt573/barkpaste/internal/keyring"
+	"github.com/xbt573/barkpaste/internal/reaper"
+	"github.com/xbt573/barkpaste/internal/repository/blob"
 	pasteRepository "github.com/xbt573/barkpaste/internal/repository/paste"
 	tokenRepository "github.com/xbt573/barkpaste/internal/repository/token"
 	pasteService "github.com/xbt573/barkpaste/internal/service/paste"
@@ -33,12 +38,33 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar((*string)(&config.Database.Type), "type", string(SQLite), "Database type (one of postgresql sqlite)")
 	rootCmd.PersistentFlags().StringVar(&config.Database.URI, "uri", "barkpaste.db", "Database URI (or file for SQLite)")
+	rootCmd.PersistentFlags().StringVar((*string)(&config.Database.Storage.Type), "storage", string(Local), "Paste content storage type (one of local s3)")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.Path, "storagepath", "barkpaste-data", "Directory for local storage")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.Endpoint, "s3endpoint", "", "S3 endpoint URL (e.g. http://127.0.0.1:9000)")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.Bucket, "s3bucket", "barkpaste", "S3 bucket")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.Region, "s3region", "us-east-1", "S3 region")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.AccessKey, "s3accesskey", "", "S3 access key")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.SecretKey, "s3secretkey", "", "S3 secret key (prefer config file)")
+	rootCmd.PersistentFlags().BoolVar(&config.Database.Storage.PathStyle, "s3pathstyle", false, "Use path-style S3 URLs (needed for MinIO)")
+	rootCmd.PersistentFlags().StringVar(&config.Database.Storage.Prefix, "s3prefix", "", "Prefix of S3 object keys (e.g. barkpaste/)")
+
+	rootCmd.PersistentFlags().StringVar(&config.Encryption.Key, "keyid", "", "ID of the master key to encrypt new pastes with (empty to not encrypt)")
+	rootCmd.PersistentFlags().StringVar(&config.Encryption.KeyFile, "keyfile", "", "File with master keys, \"id base64-key\" per line")
 
 	rootCmd.PersistentFlags().DurationVar(&config.Settings.TTL, "ttl", time.Hour*24, "TTL of pastes (default to 1d)")
 	rootCmd.PersistentFlags().UintVar(&config.Settings.Limit, "limit", 1*1024*1024, "Maximum size of paste (default to 1 MB, uint)")
 	rootCmd.PersistentFlags().UintVar(&config.Settings.BodyLimit, "bodylimit", 200*1024*1024, "Maximum size of body (default to 200 MB, uint)")
 	// FIXME: поменяй на норм перед релизом, а то засмеют
 	rootCmd.PersistentFlags().StringVar(&config.Settings.Token, "token", "verycooltokensir", "Default token (CHANGE TO SECURE)")
+	rootCmd.PersistentFlags().StringVar(&config.Settings.Pepper, "pepper", "", "Secret mixed into token hashes (keep out of the database)")
+	rootCmd.PersistentFlags().StringVar(&config.Settings.ShareSecret, "sharesecret", "", "Secret to sign share links with (random if empty, links die on restart)")
+	rootCmd.PersistentFlags().IntVar(&config.Settings.CompressThreshold, "compressthreshold", 1024, "Minimum size of paste stored compressed, 0 to disable (default to 1 KB)")
+	rootCmd.PersistentFlags().StringSliceVar(&config.Settings.AllowedTypes, "allowedtypes", nil, "Content types served as they are on top of the built-in safe ones, even though browsers may run scripts in them (e.g. text/html)")
+
+	rootCmd.PersistentFlags().DurationVar(&config.Settings.CleanInterval, "cleaninterval", time.Minute, "Interval between expired paste cleanups (default to 1m)")
+	rootCmd.PersistentFlags().IntVar(&config.Settings.CleanBatch, "cleanbatch", 1000, "Maximum pastes deleted per cleanup query (default to 1000)")
+	rootCmd.PersistentFlags().DurationVar(&config.Settings.CleanJitter, "cleanjitter", time.Second*10, "Random delay added to cleanup interval (default to 10s)")
+	rootCmd.PersistentFlags().DurationVar(&config.Settings.OrphanInterval, "orphaninterval", time.Hour, "Interval between orphaned blob cleanups (default to 1h)")
 
 	cobra.OnInitialize(func() {
 		if configFile != "" {
@@ -67,58 +93,157 @@ func init() {
 var rootCmd = &cobra.Command{
 	Use: "barkpaste",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var dialector gorm.Dialector
-
-		switch config.Database.Type {
-		case SQLite:
-			dialector = sqlite.Open(config.Database.URI)
-		case PostgreSQL:
-			dialector = postgres.Open(config.Database.URI)
-		default:
-			return fmt.Errorf("unknown database type: %v", config.Database.Type)
-		}
-
-		db, err := gorm.Open(dialector, &gorm.Config{
-			TranslateError: true,
-			Logger:         logger.Default.LogMode(logger.Silent),
-		})
-		if err != nil {
-			return err
-		}
-
-		pr, err := pasteRepository.New(db)
-		if err != nil {
-			return err
-		}
-
-		tr, err := tokenRepository.New(db, tokenRepository.Options{Token: config.Settings.Token})
+		ps, err := newPasteService()
 		if err != nil {
 			return err
 		}
 
-		ps := pasteService.New(pr, tr, pasteService.Options{
-			TTL:   config.Settings.TTL,
-			Limit: config.Settings.Limit,
+		pc := pasteController.New(ps, pasteController.Options{
+			AllowedTypes: config.Settings.AllowedTypes,
 		})
 
-		pc := pasteController.New(ps)
-
 		a := app.New(pc, app.Options{
 			BodyLimit: config.Settings.BodyLimit,
 		})
 
+		r := reaper.New(ps, reaper.Options{
+			Interval:  config.Settings.CleanInterval,
+			BatchSize: config.Settings.CleanBatch,
+			Jitter:    config.Settings.CleanJitter,
+
+			OrphanInterval: config.Settings.OrphanInterval,
+		})
+
 		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 		defer cancel()
 
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Run(ctx)
+		}()
+
 		slog.Info("running on", "addr", config.Listen)
-		if err := a.Listen(config.Listen, ctx); err != nil {
-			return err
-		}
+		err = a.Listen(config.Listen, ctx)
+
+		// listener may fail on its own, reaper must not outlive it
+		cancel()
+		<-done
 
-		return nil
+		return err
 	},
 }
 
+// newPasteService opens everything service needs and migrates it
+func newPasteService() (pasteService.Service, error) {
+	var dialector gorm.Dialector
+
+	switch config.Database.Type {
+	case SQLite:
+		dialector = sqlite.Open(config.Database.URI)
+	case PostgreSQL:
+		dialector = postgres.Open(config.Database.URI)
+	default:
+		return nil, fmt.Errorf("unknown database type: %v", config.Database.Type)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
+		TranslateError: true,
+		Logger:         logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := pasteRepository.New(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := tokenRepository.New(db, tokenRepository.Options{
+		Token:  config.Settings.Token,
+		Pepper: config.Settings.Pepper,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var br blob.Repository
+
+	switch config.Database.Storage.Type {
+	case Local:
+		br, err = blob.NewLocal(config.Database.Storage.Path)
+	case S3:
+		br, err = blob.NewS3(blob.S3Options{
+			Endpoint:  config.Database.Storage.Endpoint,
+			Bucket:    config.Database.Storage.Bucket,
+			Region:    config.Database.Storage.Region,
+			AccessKey: config.Database.Storage.AccessKey,
+			SecretKey: config.Database.Storage.SecretKey,
+			PathStyle: config.Database.Storage.PathStyle,
+			Prefix:    config.Database.Storage.Prefix,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage type: %v", config.Database.Storage.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kr, err := newKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	shareSecret := []byte(config.Settings.ShareSecret)
+	if len(shareSecret) == 0 {
+		shareSecret = make([]byte, 32)
+		if _, err := rand.Read(shareSecret); err != nil {
+			return nil, err
+		}
+
+		slog.Warn("share secret is not set, share links won't survive restart")
+	}
+
+	ps := pasteService.New(pr, tr, br, kr, pasteService.Options{
+		TTL:   config.Settings.TTL,
+		Limit: config.Settings.Limit,
+
+		CompressThreshold: config.Settings.CompressThreshold,
+		ShareSecret:       shareSecret,
+	})
+
+	if err := ps.MigrateContent(); err != nil {
+		return nil, fmt.Errorf("failed to migrate paste content: %w", err)
+	}
+
+	return ps, nil
+}
+
+func newKeyring() (keyring.Keyring, error) {
+	keys := make(map[string][]byte, len(config.Encryption.Keys))
+
+	for id, raw := range config.Encryption.Keys {
+		key, err := keyring.Decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("master key %v: %w", id, err)
+		}
+
+		keys[id] = key
+	}
+
+	if config.Encryption.KeyFile != "" {
+		fromFile, err := keyring.ReadFile(config.Encryption.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		maps.Copy(keys, fromFile)
+	}
+
+	return keyring.New(keys, config.Encryption.Key)
+}
+
 func Execute() error {
 	return rootCmd.Execute()
 }
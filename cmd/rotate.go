@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var rotateBatch int
+
+func init() {
+	rotateKeysCmd.Flags().IntVar(&rotateBatch, "batch", 100, "Blobs rotated per query (default to 100)")
+
+	rootCmd.AddCommand(rotateKeysCmd)
+}
+
+// safe to run next to a live server, blobs are switched one at a time,
+// but servers must already have the new master key in their keyring
+var rotateKeysCmd = &cobra.Command{
+	Use:   "rotate-keys",
+	Short: "Rewrap data keys with the active master key, encrypting unencrypted pastes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if config.Encryption.Key == "" {
+			return fmt.Errorf("no active master key, set --keyid")
+		}
+
+		ps, err := newPasteService()
+		if err != nil {
+			return err
+		}
+
+		rotated, err := ps.RotateKeys(rotateBatch)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("rotated master key", "key", config.Encryption.Key, "blobs", rotated)
+
+		return nil
+	},
+}
@@ -27,14 +27,25 @@ func (a *App) Listen(addr string, ctx context.Context) error {
 	})
 
 	f.Post("/token", a.pasteController.CreateToken)
+	f.Get("/token", a.pasteController.ListTokens)
 	f.Delete("/token/:token", a.pasteController.RevokeToken)
 
 	f.Post("/", a.pasteController.CreateRegular)
 	f.Post("/:id", a.pasteController.CreatePersistent)
+	// before Get, fiber registers HEAD with every GET route
+	f.Head("/:id", a.pasteController.Head)
 	f.Get("/:id", a.pasteController.Get)
 	f.Patch("/:id", a.pasteController.Update)
 	f.Delete("/:id", a.pasteController.Delete)
 
+	f.Get("/:id/revisions", a.pasteController.Revisions)
+	f.Get("/:id/diff", a.pasteController.Diff)
+	f.Post("/:id/share", a.pasteController.Share)
+
+	// name is only there for browsers to save file with it
+	f.Head("/:id/:filename", a.pasteController.Head)
+	f.Get("/:id/:filename", a.pasteController.Get)
+
 	errch := make(chan error)
 
 	go func() {
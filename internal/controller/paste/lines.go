@@ -0,0 +1,153 @@
+package paste
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// lineFilter picks lines of a paste with ?lines=, ?grep=, ?head= and
+// ?tail=, applied in that order, so ?grep=x&head=5 is first 5 matches
+type lineFilter struct {
+	// 1 based and inclusive, to == 0 means till the end
+	from, to int
+	grep     *regexp.Regexp
+	// 0 means no limit
+	head, tail int
+}
+
+// lineFilterOf is nil when request doesn't ask for any lines
+func lineFilterOf(ctx *fiber.Ctx) (*lineFilter, error) {
+	lines, grep, head, tail := ctx.Query("lines"), ctx.Query("grep"), ctx.Query("head"), ctx.Query("tail")
+	if lines == "" && grep == "" && head == "" && tail == "" {
+		return nil, nil
+	}
+
+	f := &lineFilter{from: 1}
+
+	if lines != "" {
+		from, to, ranged := strings.Cut(lines, "-")
+
+		n, err := positive(from)
+		if err != nil {
+			return nil, err
+		}
+
+		f.from, f.to = n, n
+
+		if ranged {
+			f.to = 0
+
+			if to != "" {
+				if f.to, err = positive(to); err != nil {
+					return nil, err
+				}
+
+				if f.to < f.from {
+					return nil, fmt.Errorf("invalid lines: %v", lines)
+				}
+			}
+		}
+	}
+
+	if grep != "" {
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			return nil, err
+		}
+
+		f.grep = re
+	}
+
+	if head != "" && tail != "" {
+		return nil, fmt.Errorf("head and tail don't go together")
+	}
+
+	var err error
+
+	if head != "" {
+		if f.head, err = positive(head); err != nil {
+			return nil, err
+		}
+	}
+
+	if tail != "" {
+		if f.tail, err = positive(tail); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// apply writes picked lines of content to w, going through it line by line,
+// tail only keeps the last lines it needs
+func (f *lineFilter) apply(content []byte, w io.Writer) error {
+	var (
+		last    [][]byte
+		next    int
+		written int
+	)
+
+	for number := 1; len(content) > 0; number++ {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			line = content[:i+1]
+		}
+		content = content[len(line):]
+
+		if number < f.from {
+			continue
+		}
+
+		if f.to > 0 && number > f.to {
+			break
+		}
+
+		if f.grep != nil && !f.grep.Match(bytes.TrimRight(line, "\r\n")) {
+			continue
+		}
+
+		if f.tail > 0 {
+			if len(last) < f.tail {
+				last = append(last, line)
+			} else {
+				last[next] = line
+				next = (next + 1) % f.tail
+			}
+
+			continue
+		}
+
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+
+		written++
+		if written == f.head {
+			break
+		}
+	}
+
+	for i := range last {
+		if _, err := w.Write(last[(next+i)%len(last)]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func positive(raw string) (int, error) {
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("not a positive number: %v", raw)
+	}
+
+	return n, nil
+}
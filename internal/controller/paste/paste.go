@@ -1,13 +1,26 @@
 package paste
 
 import (
+	_ "embed"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	neturl "net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/xbt573/barkpaste/internal/diff"
+	"github.com/xbt573/barkpaste/internal/models"
 	pasteService "github.com/xbt573/barkpaste/internal/service/paste"
 	"golang.org/x/net/idna"
 )
@@ -17,21 +30,33 @@ type Controller interface {
 	CreatePersistent(ctx *fiber.Ctx) error
 
 	Get(ctx *fiber.Ctx) error
+	Head(ctx *fiber.Ctx) error
+	Revisions(ctx *fiber.Ctx) error
+	Diff(ctx *fiber.Ctx) error
 
 	Update(ctx *fiber.Ctx) error
 
 	Delete(ctx *fiber.Ctx) error
 
+	Share(ctx *fiber.Ctx) error
+
 	CreateToken(ctx *fiber.Ctx) error
+	ListTokens(ctx *fiber.Ctx) error
 	RevokeToken(ctx *fiber.Ctx) error
 }
 
 type concreteController struct {
 	pasteService pasteService.Service
+	options      Options
+}
+
+type Options struct {
+	// types served as they are on top of safeTypes, e.g. text/html
+	AllowedTypes []string
 }
 
-func New(pasteService pasteService.Service) Controller {
-	return &concreteController{pasteService}
+func New(pasteService pasteService.Service, opts Options) Controller {
+	return &concreteController{pasteService, opts}
 }
 
 func (c *concreteController) CreateRegular(ctx *fiber.Ctx) error {
@@ -43,7 +68,7 @@ func (c *concreteController) CreateRegular(ctx *fiber.Ctx) error {
 	}
 
 	now := time.Now()
-	body := ctx.Body()
+	body := pasteBody(ctx)
 
 	ttl := c.pasteService.TTL()
 
@@ -65,7 +90,12 @@ func (c *concreteController) CreateRegular(ctx *fiber.Ctx) error {
 		ttl = t.Sub(now)
 	}
 
-	paste, err := c.pasteService.CreateRegular(token, body, ttl)
+	opts, err := createOptions(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	paste, err := c.pasteService.CreateRegular(token, body, ttl, opts)
 	if err != nil {
 		if errors.Is(err, pasteService.ErrExists) {
 			return ctx.Status(fiber.StatusConflict).SendString(
@@ -77,6 +107,10 @@ func (c *concreteController) CreateRegular(ctx *fiber.Ctx) error {
 			return ctx.SendStatus(fiber.StatusUnauthorized)
 		}
 
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
 		if errors.Is(err, pasteService.ErrInvalidRequest) {
 			return ctx.SendStatus(fiber.StatusBadRequest)
 		}
@@ -102,8 +136,33 @@ func (c *concreteController) CreateRegular(ctx *fiber.Ctx) error {
 
 	url := fmt.Sprintf("%v://%v/%v", scheme, host, paste.ID)
 
+	// downloads from this link get the right name
+	if paste.Filename != "" && !slices.Contains(subroutes, paste.Filename) {
+		url += "/" + neturl.PathEscape(paste.Filename)
+	}
+
 	ctx.Set("X-Expires-At", paste.ExpiredAt.Format(time.RFC3339))
+	setDigest(ctx, paste)
 	ctx.Set("Content-Location", "/"+paste.ID)
+	ctx.Set(fiber.HeaderETag, paste.ETag())
+
+	if paste.BurnAfterRead {
+		ctx.Set("X-Burn-After-Read", "true")
+	}
+
+	if paste.Encrypted {
+		ctx.Set("X-Encrypted", "true")
+	}
+
+	setVisibility(ctx, paste.Visibility)
+
+	if paste.MaxViews > 0 {
+		ctx.Set("X-Views-Remaining", strconv.FormatUint(uint64(paste.MaxViews), 10))
+	}
+
+	if paste.DeleteKey != "" {
+		ctx.Set("X-Delete-Key", paste.DeleteKey)
+	}
 
 	return ctx.Status(fiber.StatusCreated).SendString(url)
 }
@@ -119,7 +178,7 @@ func (c *concreteController) CreatePersistent(ctx *fiber.Ctx) error {
 	id := ctx.Params("id")
 
 	now := time.Now()
-	body := ctx.Body()
+	body := pasteBody(ctx)
 
 	ttl := time.Duration(0)
 
@@ -141,7 +200,12 @@ func (c *concreteController) CreatePersistent(ctx *fiber.Ctx) error {
 		ttl = t.Sub(now)
 	}
 
-	paste, err := c.pasteService.CreatePersistent(token, id, body, ttl)
+	opts, err := createOptions(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	paste, err := c.pasteService.CreatePersistent(token, id, body, ttl, opts)
 	if err != nil {
 		if errors.Is(err, pasteService.ErrExists) {
 			return ctx.SendStatus(fiber.StatusConflict)
@@ -159,6 +223,10 @@ func (c *concreteController) CreatePersistent(ctx *fiber.Ctx) error {
 			return ctx.SendStatus(fiber.StatusUnauthorized)
 		}
 
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
 		slog.Error("internal error", "err", err)
 		return ctx.SendStatus(fiber.StatusInternalServerError)
 	}
@@ -176,32 +244,173 @@ func (c *concreteController) CreatePersistent(ctx *fiber.Ctx) error {
 
 	url := fmt.Sprintf("%v://%v/%v", scheme, host, paste.ID)
 
+	// downloads from this link get the right name
+	if paste.Filename != "" && !slices.Contains(subroutes, paste.Filename) {
+		url += "/" + neturl.PathEscape(paste.Filename)
+	}
+
 	ctx.Set("X-Expires-At", paste.ExpiredAt.Format(time.RFC3339))
+	setDigest(ctx, paste)
 	ctx.Set("Content-Location", "/"+paste.ID)
+	ctx.Set(fiber.HeaderETag, paste.ETag())
+
+	if paste.BurnAfterRead {
+		ctx.Set("X-Burn-After-Read", "true")
+	}
+
+	if paste.Encrypted {
+		ctx.Set("X-Encrypted", "true")
+	}
+
+	setVisibility(ctx, paste.Visibility)
+
+	if paste.MaxViews > 0 {
+		ctx.Set("X-Views-Remaining", strconv.FormatUint(uint64(paste.MaxViews), 10))
+	}
 
 	return ctx.Status(fiber.StatusCreated).SendString(url)
 }
 
+//go:embed viewer.html
+var viewer []byte
+
 // TODO: сделать лимит выше для токенизированных блядей
 func (c *concreteController) Get(ctx *fiber.Ctx) error {
-	id := ctx.Params("id")
+	token := ""
+
+	rawToken := ctx.Get("Authorization")
+	if rawToken != "" {
+		fmt.Sscanf(rawToken, "Bearer %v", &token)
+	}
+
+	id, revision, err := pasteID(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	// browsers get a page that decrypts encrypted pastes with key from URL
+	// fragment, it fetches the paste itself, so loading it isn't a read
+	ctx.Vary(fiber.HeaderAccept)
+	if ctx.Accepts(fiber.MIMEOctetStream, fiber.MIMETextHTML) == fiber.MIMETextHTML {
+		paste, err := c.pasteService.Peek(token, id, ctx.Query("share"))
+		if err == nil && paste.Encrypted {
+			ctx.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+			ctx.Set(fiber.HeaderCacheControl, "no-store")
+			ctx.Type("html", "utf-8")
+
+			return ctx.Send(viewer)
+		}
+	}
+
+	opts := pasteService.GetOptions{
+		Password:  password(ctx),
+		Share:     ctx.Query("share"),
+		Revision:  revision,
+		NoneMatch: ifNoneMatch(ctx),
+	}
+
+	if t, err := http.ParseTime(ctx.Get(fiber.HeaderIfModifiedSince)); err == nil {
+		opts.ModifiedSince = t
+	}
+
+	var (
+		ranges []pasteService.Range
+		size   int64
+	)
+
+	// lines are picked from whole decompressed content
+	filter, err := lineFilterOf(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// server only has ciphertext of encrypted pastes, that's checked
+	// before Get so the read isn't counted, Get answers other errors
+	if filter != nil {
+		paste, err := c.pasteService.Peek(token, id, ctx.Query("share"))
+		if err == nil && paste.Encrypted {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+
+	if header := ctx.Get(fiber.HeaderRange); header != "" && filter == nil {
+		opts.Ranges = func(paste models.Paste) ([]pasteService.Range, error) {
+			if !ifRange(ctx, paste) {
+				return nil, nil
+			}
+
+			var err error
+
+			ranges, err = byteRanges(header, paste.Size)
+			size = paste.Size
+
+			return ranges, err
+		}
+	}
+
+	// stored compressed bytes are sent as they are if client takes them,
+	// fiber accepts anything when header is missing, so check it first
+	if ctx.Get(fiber.HeaderAcceptEncoding) != "" && filter == nil {
+		if encoding := ctx.AcceptsEncodings(models.EncodingZstd); encoding != "" {
+			opts.Encodings = append(opts.Encodings, encoding)
+		}
+	}
 
-	paste, err := c.pasteService.Get(id)
+	paste, err := c.pasteService.Get(token, id, opts)
 	if err != nil {
+		if errors.Is(err, pasteService.ErrNotModified) {
+			// stored encoding, content would be sent decompressed
+			// unless client takes it
+			if !slices.Contains(opts.Encodings, paste.Encoding) {
+				paste.Encoding = models.EncodingIdentity
+			}
+
+			ctx.Vary(fiber.HeaderAcceptEncoding)
+			setCaching(ctx, paste, revision != 0)
+
+			return ctx.SendStatus(fiber.StatusNotModified)
+		}
+
 		if errors.Is(err, pasteService.ErrNotFound) {
 			return ctx.SendStatus(fiber.StatusNotFound)
 		}
 
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="barkpaste", charset="UTF-8"`)
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrTooManyAttempts) {
+			return ctx.SendStatus(fiber.StatusTooManyRequests)
+		}
+
+		if errors.Is(err, errUnsatisfiable) {
+			ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%v", size))
+			return ctx.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+
 		slog.Error("internal error", "err", err)
 		return ctx.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	if time.Now().After(paste.ExpiredAt) {
-		// FIXME: крон
-		return ctx.SendStatus(fiber.StatusNotFound)
+	c.setHeaders(ctx, paste, revision != 0)
+
+	if filter == nil {
+		ctx.Set(fiber.HeaderAcceptRanges, "bytes")
 	}
 
-	ctx.Set("X-Expires-At", paste.ExpiredAt.Format(time.RFC3339))
+	ctx.Vary(fiber.HeaderAcceptEncoding)
+	if paste.Encoding != models.EncodingIdentity {
+		ctx.Set(fiber.HeaderContentEncoding, paste.Encoding)
+	}
+
+	if ranges != nil {
+		return sendRanges(ctx, paste.Content, ranges, size)
+	}
+
+	if filter != nil {
+		return filter.apply(paste.Content, ctx)
+	}
 
 	_, err = ctx.Write(paste.Content)
 	if err != nil {
@@ -211,7 +420,9 @@ func (c *concreteController) Get(ctx *fiber.Ctx) error {
 	return nil
 }
 
-func (c *concreteController) Update(ctx *fiber.Ctx) error {
+// Head answers with headers Get would send, without reading content, so
+// it isn't counted as a read and doesn't burn pastes
+func (c *concreteController) Head(ctx *fiber.Ctx) error {
 	token := ""
 
 	rawToken := ctx.Get("Authorization")
@@ -219,81 +430,140 @@ func (c *concreteController) Update(ctx *fiber.Ctx) error {
 		fmt.Sscanf(rawToken, "Bearer %v", &token)
 	}
 
-	id := ctx.Params("id")
+	id, revision, err := pasteID(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
 
-	now := time.Now()
-	body := ctx.Body()
+	opts := pasteService.GetOptions{
+		Password:  password(ctx),
+		Share:     ctx.Query("share"),
+		Revision:  revision,
+		NoneMatch: ifNoneMatch(ctx),
+	}
 
-	ttl := time.Duration(0)
+	if t, err := http.ParseTime(ctx.Get(fiber.HeaderIfModifiedSince)); err == nil {
+		opts.ModifiedSince = t
+	}
 
-	if header := ctx.Get("X-Expires-After"); header != "" {
-		num, err := strconv.Atoi(header)
-		if err != nil {
-			return ctx.SendStatus(fiber.StatusBadRequest)
-		}
+	paste, err := c.pasteService.Stat(token, id, opts)
 
-		ttl = time.Second * time.Duration(num)
-	}
+	// headers are of decompressed content, Content-Length is its size
+	paste.Encoding = models.EncodingIdentity
 
-	if header := ctx.Get("X-Expires-At"); header != "" {
-		t, err := time.Parse(time.RFC3339, header)
-		if err != nil {
-			return ctx.SendStatus(fiber.StatusBadRequest)
+	if err != nil {
+		if errors.Is(err, pasteService.ErrNotModified) {
+			ctx.Vary(fiber.HeaderAcceptEncoding)
+			setCaching(ctx, paste, revision != 0)
+
+			return ctx.SendStatus(fiber.StatusNotModified)
 		}
 
-		ttl = t.Sub(now)
+		return readError(ctx, err)
 	}
 
-	paste, err := c.pasteService.Get(id)
-	if err != nil {
-		if errors.Is(err, pasteService.ErrInvalidRequest) {
-			return ctx.SendStatus(fiber.StatusBadRequest)
-		}
+	// same filters as Get, lines of encrypted pastes can't be picked
+	filter, err := lineFilterOf(ctx)
+	if err != nil || filter != nil && paste.Encrypted {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
 
-		if errors.Is(err, pasteService.ErrTooBig) {
-			return ctx.SendStatus(fiber.StatusRequestEntityTooLarge)
-		}
+	c.setHeaders(ctx, paste, revision != 0)
 
-		slog.Error("internal error", "err", err)
-		return ctx.SendStatus(fiber.StatusInternalServerError)
+	if filter == nil {
+		ctx.Set(fiber.HeaderAcceptRanges, "bytes")
 	}
 
-	if time.Now().After(paste.ExpiredAt) {
-		// FIXME: крон
-		return ctx.SendStatus(fiber.StatusNotFound)
+	// share link may count reads of a paste that doesn't count them itself
+	counted, err := c.pasteService.Counted(token, id, ctx.Query("share"))
+	if err != nil {
+		return readError(ctx, err)
 	}
 
-	if len(body) > 0 {
-		paste.Content = body
+	if counted {
+		ctx.Response().Header.Del("X-Content-Sha256")
 	}
 
-	if ttl > 0 {
-		paste.ExpiredAt = time.Now().Add(ttl)
+	// nothing was read, the one read is still there
+	if paste.BurnAfterRead {
+		ctx.Set("X-Views-Remaining", "1")
 	}
+	ctx.Vary(fiber.HeaderAcceptEncoding)
 
-	paste, err = c.pasteService.Update(token, paste)
-	if err != nil {
-		if errors.Is(err, pasteService.ErrInvalidRequest) {
-			return ctx.SendStatus(fiber.StatusBadRequest)
-		}
+	// picked lines are only known once content is read
+	if filter != nil {
+		return nil
+	}
 
-		if errors.Is(err, pasteService.ErrTooBig) {
-			return ctx.SendStatus(fiber.StatusRequestEntityTooLarge)
-		}
+	var ranges []pasteService.Range
 
-		if errors.Is(err, pasteService.ErrUnauthorized) {
-			return ctx.SendStatus(fiber.StatusUnauthorized)
+	if header := ctx.Get(fiber.HeaderRange); header != "" && ifRange(ctx, paste) {
+		ranges, err = byteRanges(header, paste.Size)
+		if err != nil {
+			ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%v", paste.Size))
+			return ctx.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
 		}
+	}
 
-		slog.Error("internal error", "err", err)
-		return ctx.SendStatus(fiber.StatusInternalServerError)
+	switch len(ranges) {
+	case 0:
+		ctx.Response().Header.SetContentLength(int(paste.Size))
+	case 1:
+		r := ranges[0]
+
+		ctx.Status(fiber.StatusPartialContent)
+		ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %v-%v/%v", r.Start, r.End-1, paste.Size))
+		ctx.Response().Header.SetContentLength(int(r.End - r.Start))
+	default:
+		// multipart body has a random boundary, its length isn't known either
+		ctx.Status(fiber.StatusPartialContent)
+		ctx.Set(fiber.HeaderContentType, "multipart/byteranges")
 	}
 
-	ctx.Set("X-Expires-At", paste.ExpiredAt.Format(time.RFC3339))
 	return nil
 }
 
-func (c *concreteController) Delete(ctx *fiber.Ctx) error {
+// setDigest sets X-Content-Sha256, but not for pastes with counted reads,
+// it would let their content be guessed without reading it
+func setDigest(ctx *fiber.Ctx, paste models.Paste) {
+	if !paste.Counted() {
+		ctx.Set("X-Content-Sha256", paste.BlobKey)
+	}
+}
+
+// setHeaders sets headers describing paste, same for Get and Head
+func (c *concreteController) setHeaders(ctx *fiber.Ctx, paste models.Paste, revision bool) {
+	ctx.Set("X-Expires-At", paste.ExpiredAt.Format(time.RFC3339))
+	setDigest(ctx, paste)
+	ctx.Set("X-Revision", strconv.FormatUint(uint64(paste.Revision), 10))
+	ctx.Set(fiber.HeaderContentType, c.servedType(paste.ContentType, ctx.Context().QueryArgs().Has("download")))
+	ctx.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	setDisposition(ctx, paste)
+	setCaching(ctx, paste, revision)
+
+	if paste.Encrypted {
+		ctx.Set("X-Encrypted", "true")
+	}
+
+	setVisibility(ctx, paste.Visibility)
+
+	switch {
+	case paste.BurnAfterRead:
+		ctx.Set("X-Views-Remaining", "0")
+	case paste.MaxViews > 0:
+		ctx.Set("X-Views-Remaining", strconv.FormatUint(uint64(paste.MaxViews-paste.Views), 10))
+	}
+}
+
+type revisionInfo struct {
+	Revision    uint      `json:"revision"`
+	Size        int64     `json:"size"`
+	Sha256      string    `json:"sha256,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (c *concreteController) Revisions(ctx *fiber.Ctx) error {
 	token := ""
 
 	rawToken := ctx.Get("Authorization")
@@ -303,64 +573,903 @@ func (c *concreteController) Delete(ctx *fiber.Ctx) error {
 
 	id := ctx.Params("id")
 
-	_, err := c.pasteService.Delete(token, id)
+	revisions, err := c.pasteService.Revisions(token, id, pasteService.GetOptions{
+		Password: password(ctx),
+		Share:    ctx.Query("share"),
+	})
 	if err != nil {
 		if errors.Is(err, pasteService.ErrNotFound) {
 			return ctx.SendStatus(fiber.StatusNotFound)
 		}
 
 		if errors.Is(err, pasteService.ErrUnauthorized) {
+			ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="barkpaste", charset="UTF-8"`)
 			return ctx.SendStatus(fiber.StatusUnauthorized)
 		}
 
+		if errors.Is(err, pasteService.ErrTooManyAttempts) {
+			return ctx.SendStatus(fiber.StatusTooManyRequests)
+		}
+
 		slog.Error("internal error", "err", err)
 		return ctx.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	return nil
+	// listing is free, digests would let content be guessed without a read
+	counted, err := c.pasteService.Counted(token, id, ctx.Query("share"))
+	if err != nil {
+		return readError(ctx, err)
+	}
+
+	infos := make([]revisionInfo, len(revisions))
+	for i, r := range revisions {
+		infos[i] = revisionInfo{
+			Revision:    r.Number,
+			Size:        r.Size,
+			ContentType: r.ContentType,
+			CreatedAt:   r.CreatedAt,
+		}
+
+		if !counted {
+			infos[i].Sha256 = r.BlobKey
+		}
+	}
+
+	return ctx.JSON(infos)
 }
 
-func (c *concreteController) CreateToken(ctx *fiber.Ctx) error {
-	accessToken := ""
+//go:embed diff.html
+var diffPage string
+
+var diffTemplate = template.Must(template.New("diff").Parse(diffPage))
+
+type diffLine struct {
+	Number int
+	Text   string
+}
+
+type diffRow struct {
+	Left, Right diffLine
+	Changed     bool
+}
+
+// Diff compares revisions of a paste or different pastes, from and to are
+// revision numbers of this paste, or other pastes as <id> or <id>@<revision>.
+// Side that isn't given is this paste, and without both current revision is
+// compared to previous one. Sides are read one by one, so pastes whose reads
+// are counted can't be compared, first read could burn paste second one needs
+func (c *concreteController) Diff(ctx *fiber.Ctx) error {
+	// fiber routes HEAD here too, it would count reads for nothing
+	if ctx.Method() == fiber.MethodHead {
+		ctx.Set(fiber.HeaderAllow, fiber.MethodGet)
+		return ctx.SendStatus(fiber.StatusMethodNotAllowed)
+	}
+
+	token := ""
 
 	rawToken := ctx.Get("Authorization")
 	if rawToken != "" {
-		fmt.Sscanf(rawToken, "Bearer %v", &accessToken)
+		fmt.Sscanf(rawToken, "Bearer %v", &token)
 	}
 
-	token, err := c.pasteService.CreateToken(accessToken)
+	id, revision, err := pasteID(ctx)
 	if err != nil {
-		if errors.Is(err, pasteService.ErrUnauthorized) {
-			return ctx.SendStatus(fiber.StatusUnauthorized)
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	fromID, fromRevision, err := diffSide(id, revision, ctx.Query("from"))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	toID, toRevision, err := diffSide(id, revision, ctx.Query("to"))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	opts := func(revision uint) pasteService.GetOptions {
+		return pasteService.GetOptions{
+			Password: password(ctx),
+			Share:    ctx.Query("share"),
+			Revision: revision,
 		}
+	}
 
-		slog.Error("internal error", "err", err)
-		return ctx.SendStatus(fiber.StatusInternalServerError)
+	// sides are looked at before they're read, reads count and encrypted
+	// pastes can't be compared anyway, server only has their ciphertext
+	current, err := c.pasteService.Peek(token, toID, ctx.Query("share"))
+	if err != nil {
+		return readError(ctx, err)
 	}
 
-	_, err = ctx.WriteString(token)
-	return err
+	other, err := c.pasteService.Peek(token, fromID, ctx.Query("share"))
+	if err != nil {
+		return readError(ctx, err)
+	}
+
+	if current.Encrypted || other.Encrypted {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	for _, side := range []string{toID, fromID} {
+		counted, err := c.pasteService.Counted(token, side, ctx.Query("share"))
+		if err != nil {
+			return readError(ctx, err)
+		}
+
+		if counted {
+			return ctx.SendStatus(fiber.StatusConflict)
+		}
+	}
+
+	if ctx.Query("from") == "" && ctx.Query("to") == "" {
+		if toRevision == 0 {
+			toRevision = current.Revision
+		}
+
+		if toRevision <= 1 {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		fromRevision = toRevision - 1
+	}
+
+	to, err := c.pasteService.Get(token, toID, opts(toRevision))
+	if err != nil {
+		return readError(ctx, err)
+	}
+
+	from, err := c.pasteService.Get(token, fromID, opts(fromRevision))
+	if err != nil {
+		return readError(ctx, err)
+	}
+
+	if from.Visibility != models.VisibilityPublic || to.Visibility != models.VisibilityPublic {
+		ctx.Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	fromName := fmt.Sprintf("%v@%v", fromID, from.Revision)
+	toName := fmt.Sprintf("%v@%v", toID, to.Revision)
+
+	a, b := diff.Lines(from.Content), diff.Lines(to.Content)
+	edits := diff.Compute(a, b)
+
+	ctx.Vary(fiber.HeaderAccept)
+
+	format := ctx.Query("format")
+	if format == "html" || format == "" && ctx.Accepts(fiber.MIMETextPlain, fiber.MIMETextHTML) == fiber.MIMETextHTML {
+		line := func(lines []string, i int) diffLine {
+			if i < 0 {
+				return diffLine{}
+			}
+
+			return diffLine{i + 1, strings.TrimSuffix(lines[i], "\n")}
+		}
+
+		var rows []diffRow
+		for _, r := range diff.SideBySide(edits) {
+			rows = append(rows, diffRow{line(a, r.A), line(b, r.B), r.Changed})
+		}
+
+		ctx.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; style-src 'unsafe-inline'")
+		ctx.Type("html", "utf-8")
+
+		return diffTemplate.Execute(ctx, map[string]any{
+			"From": fromName,
+			"To":   toName,
+			"Rows": rows,
+		})
+	}
+
+	ctx.Type("txt", "utf-8")
+
+	return ctx.SendString(diff.Unified("a/"+fromName, "b/"+toName, a, b, edits, 3))
 }
 
-func (c *concreteController) RevokeToken(ctx *fiber.Ctx) error {
-	accessToken := ""
+func (c *concreteController) Update(ctx *fiber.Ctx) error {
+	token := ""
 
 	rawToken := ctx.Get("Authorization")
 	if rawToken != "" {
-		fmt.Sscanf(rawToken, "Bearer %v", &accessToken)
+		fmt.Sscanf(rawToken, "Bearer %v", &token)
 	}
 
-	token := ctx.Params("token")
+	id := ctx.Params("id")
 
-	err := c.pasteService.RevokeToken(accessToken, token)
-	if err != nil {
-		if errors.Is(err, pasteService.ErrUnauthorized) {
-			return ctx.SendStatus(fiber.StatusUnauthorized)
-		}
+	now := time.Now()
+	// same forms as on creation, file name stays as it was
+	body := pasteBody(ctx)
 
-		slog.Error("internal error", "err", err)
-		return ctx.SendStatus(fiber.StatusInternalServerError)
+	contentType := declaredType(ctx)
+	if file := uploaded(ctx); file != nil {
+		contentType = uploadedType(file)
 	}
 
-	return nil
+	ttl := time.Duration(0)
+
+	if header := ctx.Get("X-Expires-After"); header != "" {
+		num, err := strconv.Atoi(header)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		ttl = time.Second * time.Duration(num)
+	}
+
+	if header := ctx.Get("X-Expires-At"); header != "" {
+		t, err := time.Parse(time.RFC3339, header)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		ttl = t.Sub(now)
+	}
+
+	paste, err := c.pasteService.Update(token, id, body, ttl, pasteService.UpdateOptions{
+		ContentType: contentType,
+		Match:       ifMatch(ctx),
+	})
+	if err != nil {
+		if errors.Is(err, pasteService.ErrNotFound) {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		if errors.Is(err, pasteService.ErrPreconditionFailed) {
+			return ctx.SendStatus(fiber.StatusPreconditionFailed)
+		}
+
+		if errors.Is(err, pasteService.ErrExists) {
+			return ctx.SendStatus(fiber.StatusConflict)
+		}
+
+		if errors.Is(err, pasteService.ErrInvalidRequest) {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		if errors.Is(err, pasteService.ErrTooBig) {
+			return ctx.SendStatus(fiber.StatusRequestEntityTooLarge)
+		}
+
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		slog.Error("internal error", "err", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	ctx.Set("X-Expires-At", paste.ExpiredAt.Format(time.RFC3339))
+	setDigest(ctx, paste)
+	ctx.Set("X-Revision", strconv.FormatUint(uint64(paste.Revision), 10))
+	ctx.Set(fiber.HeaderETag, paste.ETag())
+	return nil
+}
+
+func (c *concreteController) Delete(ctx *fiber.Ctx) error {
+	token := ""
+
+	rawToken := ctx.Get("Authorization")
+	if rawToken != "" {
+		fmt.Sscanf(rawToken, "Bearer %v", &token)
+	}
+
+	id := ctx.Params("id")
+
+	_, err := c.pasteService.Delete(token, ctx.Get("X-Delete-Key"), id, ifMatch(ctx))
+	if err != nil {
+		if errors.Is(err, pasteService.ErrNotFound) {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		if errors.Is(err, pasteService.ErrPreconditionFailed) {
+			return ctx.SendStatus(fiber.StatusPreconditionFailed)
+		}
+
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		slog.Error("internal error", "err", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func (c *concreteController) Share(ctx *fiber.Ctx) error {
+	token := ""
+
+	rawToken := ctx.Get("Authorization")
+	if rawToken != "" {
+		fmt.Sscanf(rawToken, "Bearer %v", &token)
+	}
+
+	id := ctx.Params("id")
+
+	now := time.Now()
+
+	var opts pasteService.ShareOptions
+
+	if header := ctx.Get("X-Expires-After"); header != "" {
+		num, err := strconv.Atoi(header)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		opts.TTL = time.Second * time.Duration(num)
+	}
+
+	if header := ctx.Get("X-Expires-At"); header != "" {
+		t, err := time.Parse(time.RFC3339, header)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		opts.TTL = t.Sub(now)
+	}
+
+	if header := ctx.Get("X-Max-Uses"); header != "" {
+		uses, err := strconv.ParseUint(header, 10, 0)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		opts.MaxUses = uint(uses)
+	}
+
+	share, expires, err := c.pasteService.Share(token, id, opts)
+	if err != nil {
+		if errors.Is(err, pasteService.ErrNotFound) {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		if errors.Is(err, pasteService.ErrInvalidRequest) {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		slog.Error("internal error", "err", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	scheme := "http"
+	if ctx.Protocol() == "https" {
+		scheme = "https"
+	}
+
+	host := ctx.Hostname()
+	host, err = idna.ToUnicode(host)
+	if err != nil {
+		slog.Error("shouldn't happen", "err", err)
+	}
+
+	url := fmt.Sprintf("%v://%v/%v?share=%v", scheme, host, id, share)
+
+	ctx.Set("X-Expires-At", expires.Format(time.RFC3339))
+
+	if opts.MaxUses > 0 {
+		ctx.Set("X-Max-Uses", strconv.FormatUint(uint64(opts.MaxUses), 10))
+	}
+
+	return ctx.Status(fiber.StatusCreated).SendString(url)
+}
+
+func (c *concreteController) CreateToken(ctx *fiber.Ctx) error {
+	accessToken := ""
+
+	rawToken := ctx.Get("Authorization")
+	if rawToken != "" {
+		fmt.Sscanf(rawToken, "Bearer %v", &accessToken)
+	}
+
+	scopes, err := models.ParseScopes(ctx.Get("X-Scopes"))
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	now := time.Now()
+	ttl := time.Duration(0)
+
+	if header := ctx.Get("X-Expires-After"); header != "" {
+		num, err := strconv.Atoi(header)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		ttl = time.Second * time.Duration(num)
+	}
+
+	if header := ctx.Get("X-Expires-At"); header != "" {
+		t, err := time.Parse(time.RFC3339, header)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		ttl = t.Sub(now)
+	}
+
+	token, err := c.pasteService.CreateToken(accessToken, pasteService.TokenOptions{
+		Name:   ctx.Get("X-Token-Name"),
+		Scopes: scopes,
+		TTL:    ttl,
+	})
+	if err != nil {
+		if errors.Is(err, pasteService.ErrInvalidRequest) {
+			return ctx.SendStatus(fiber.StatusBadRequest)
+		}
+
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		slog.Error("internal error", "err", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	_, err = ctx.WriteString(token)
+	return err
+}
+
+type tokenInfo struct {
+	Prefix     string        `json:"prefix"`
+	Name       string        `json:"name,omitempty"`
+	Scopes     models.Scopes `json:"scopes"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsedAt *time.Time    `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time    `json:"expires_at,omitempty"`
+}
+
+func (c *concreteController) ListTokens(ctx *fiber.Ctx) error {
+	accessToken := ""
+
+	rawToken := ctx.Get("Authorization")
+	if rawToken != "" {
+		fmt.Sscanf(rawToken, "Bearer %v", &accessToken)
+	}
+
+	tokens, err := c.pasteService.ListTokens(accessToken)
+	if err != nil {
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		slog.Error("internal error", "err", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// never the hash, prefix is enough to tell tokens apart
+	infos := make([]tokenInfo, len(tokens))
+	for i, t := range tokens {
+		infos[i] = tokenInfo{
+			Prefix:     t.Prefix,
+			Name:       t.Name,
+			Scopes:     t.Scopes,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+			ExpiresAt:  t.ExpiresAt,
+		}
+	}
+
+	return ctx.JSON(infos)
+}
+
+func (c *concreteController) RevokeToken(ctx *fiber.Ctx) error {
+	accessToken := ""
+
+	rawToken := ctx.Get("Authorization")
+	if rawToken != "" {
+		fmt.Sscanf(rawToken, "Bearer %v", &accessToken)
+	}
+
+	token := ctx.Params("token")
+
+	err := c.pasteService.RevokeToken(accessToken, token)
+	if err != nil {
+		if errors.Is(err, pasteService.ErrNotFound) {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		if errors.Is(err, pasteService.ErrUnauthorized) {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		if errors.Is(err, pasteService.ErrForbidden) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		slog.Error("internal error", "err", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func createOptions(ctx *fiber.Ctx) (pasteService.CreateOptions, error) {
+	var opts pasteService.CreateOptions
+
+	if header := ctx.Get("X-Burn-After-Read"); header != "" {
+		burn, err := strconv.ParseBool(header)
+		if err != nil {
+			return opts, err
+		}
+
+		opts.BurnAfterRead = burn
+	}
+
+	if header := ctx.Get("X-Max-Views"); header != "" {
+		views, err := strconv.ParseUint(header, 10, 0)
+		if err != nil {
+			return opts, err
+		}
+
+		opts.MaxViews = uint(views)
+	}
+
+	if header := ctx.Get("X-Encrypted"); header != "" {
+		encrypted, err := strconv.ParseBool(header)
+		if err != nil {
+			return opts, err
+		}
+
+		opts.Encrypted = encrypted
+	}
+
+	visibility, err := models.ParseVisibility(ctx.Get("X-Visibility"))
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Visibility = visibility
+
+	opts.Password = ctx.Get("X-Password")
+	if opts.Password == "" {
+		opts.Password = formValue(ctx, "password")
+	}
+
+	opts.ContentType = declaredType(ctx)
+
+	if file := uploaded(ctx); file != nil {
+		opts.Filename = file.Filename
+		opts.ContentType = uploadedType(file)
+	}
+
+	return opts, nil
+}
+
+// uploadedType is Content-Type of uploaded file, empty when it says nothing
+func uploadedType(file *multipart.FileHeader) string {
+	contentType := file.Header.Get(fiber.HeaderContentType)
+
+	// what curl says about any file it doesn't know
+	if mediatype, _, _ := mime.ParseMediaType(contentType); mediatype == fiber.MIMEOctetStream {
+		return ""
+	}
+
+	return contentType
+}
+
+// GET routes under a paste, see app, link with a file named like one of
+// them would lead there, so it goes without the name
+var subroutes = []string{"revisions", "diff"}
+
+// declaredType is Content-Type of paste, curl sends everything as a form
+// by default, so forms say nothing about it
+func declaredType(ctx *fiber.Ctx) string {
+	contentType := ctx.Get(fiber.HeaderContentType)
+
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediatype == fiber.MIMEApplicationForm || mediatype == fiber.MIMEMultipartForm {
+		return ""
+	}
+
+	return contentType
+}
+
+// setDisposition names the file, ?download makes browsers save it instead
+// of showing, name from /<id>/<filename> is used when paste has none
+func setDisposition(ctx *fiber.Ctx, paste models.Paste) {
+	download := ctx.Context().QueryArgs().Has("download")
+
+	name := paste.Filename
+	if name == "" {
+		name, _ = neturl.PathUnescape(ctx.Params("filename"))
+
+		if strings.ContainsFunc(name, unicode.IsControl) {
+			name = ""
+		}
+	}
+
+	if name == "" && download {
+		name = paste.ID
+	}
+
+	if name == "" {
+		return
+	}
+
+	disposition := "inline"
+	if download {
+		disposition = "attachment"
+	}
+
+	if header := mime.FormatMediaType(disposition, map[string]string{"filename": name}); header != "" {
+		ctx.Set(fiber.HeaderContentDisposition, header)
+	}
+}
+
+// types browsers only show or download, anything else could be run by them
+// (HTML, SVG, XML with stylesheets, ...) and is sent as text
+var safeTypes = []string{
+	"text/plain", "text/markdown", "text/csv",
+	"text/x-diff", "text/x-go", "text/x-python", "text/x-shellscript", "text/x-c", "text/x-rust",
+	"application/json", "application/yaml", "application/toml", "application/sql",
+	"application/pdf", "application/octet-stream", "application/zip", "application/gzip",
+	"application/x-tar", "application/zstd", "application/wasm",
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif", "image/bmp", "image/x-icon",
+	"audio/mpeg", "audio/ogg", "audio/wav", "audio/webm", "audio/flac",
+	"video/mp4", "video/webm", "video/ogg",
+	"font/woff", "font/woff2", "font/ttf", "font/otf",
+}
+
+// types other sites could load from paste origin with <script> or <link>,
+// they are only sent as they are when paste is downloaded
+var downloadTypes = []string{"text/css", "text/javascript", "application/javascript"}
+
+// servedType is content type paste is sent with, types which aren't
+// known to be safe are downgraded to text unless they're allowed
+func (c *concreteController) servedType(contentType string, download bool) string {
+	// pastes from before types were stored
+	if contentType == "" {
+		return fiber.MIMETextPlainCharsetUTF8
+	}
+
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fiber.MIMETextPlainCharsetUTF8
+	}
+
+	if download && slices.Contains(downloadTypes, mediatype) {
+		return contentType
+	}
+
+	if !slices.Contains(safeTypes, mediatype) && !slices.Contains(c.options.AllowedTypes, mediatype) {
+		return fiber.MIMETextPlainCharsetUTF8
+	}
+
+	return contentType
+}
+
+func setVisibility(ctx *fiber.Ctx, visibility models.Visibility) {
+	ctx.Set("X-Visibility", string(visibility))
+
+	// unlisted links leak into search engines all the time
+	if visibility != models.VisibilityPublic {
+		ctx.Set("X-Robots-Tag", "noindex, nofollow")
+	}
+}
+
+// pasteID splits /<id>@<revision>, revision is 0 when not there
+func pasteID(ctx *fiber.Ctx) (string, uint, error) {
+	return splitRevision(ctx.Params("id"))
+}
+
+func splitRevision(id string) (string, uint, error) {
+	i := strings.LastIndexByte(id, '@')
+	if i < 0 {
+		return id, 0, nil
+	}
+
+	revision, err := strconv.ParseUint(id[i+1:], 10, 0)
+	if err != nil || revision == 0 {
+		return "", 0, fmt.Errorf("invalid revision: %v", id[i+1:])
+	}
+
+	return id[:i], uint(revision), nil
+}
+
+// diffSide is side of a diff in ?from= or ?to=, a number is revision of
+// paste being diffed, anything else is <id> or <id>@<revision>
+func diffSide(id string, revision uint, raw string) (string, uint, error) {
+	if raw == "" {
+		return id, revision, nil
+	}
+
+	if number, err := strconv.ParseUint(raw, 10, 0); err == nil {
+		if number == 0 {
+			return "", 0, fmt.Errorf("invalid revision: %v", raw)
+		}
+
+		return id, uint(number), nil
+	}
+
+	return splitRevision(raw)
+}
+
+// readError answers errors of reading a paste
+func readError(ctx *fiber.Ctx, err error) error {
+	if errors.Is(err, pasteService.ErrNotFound) {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	if errors.Is(err, pasteService.ErrUnauthorized) {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="barkpaste", charset="UTF-8"`)
+		return ctx.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	if errors.Is(err, pasteService.ErrTooManyAttempts) {
+		return ctx.SendStatus(fiber.StatusTooManyRequests)
+	}
+
+	slog.Error("internal error", "err", err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+// setCaching lets caches keep old revisions until paste expires, current
+// content can be changed any time, so caches revalidate it on every use.
+// ETag is of paste.Encoding, that's what content is sent in
+func setCaching(ctx *fiber.Ctx, paste models.Paste, revision bool) {
+	ctx.Set(fiber.HeaderETag, paste.EncodedETag(paste.Encoding))
+
+	// every read counts, or content is behind a password
+	if paste.BurnAfterRead || paste.MaxViews > 0 || len(paste.PasswordHash) > 0 {
+		ctx.Set(fiber.HeaderCacheControl, "no-store")
+		return
+	}
+
+	if modified := paste.LastModified(); !modified.IsZero() {
+		ctx.Set(fiber.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+	}
+
+	scope := "public"
+	if paste.Visibility == models.VisibilityPrivate {
+		scope = "private"
+	}
+
+	// persistent pastes expire in year 9999, HTTP only goes a year ahead
+	expires := paste.ExpiredAt
+	if year := time.Now().AddDate(1, 0, 0); expires.After(year) {
+		expires = year
+	}
+
+	ctx.Set(fiber.HeaderExpires, expires.UTC().Format(http.TimeFormat))
+
+	if revision {
+		ctx.Set(fiber.HeaderCacheControl, fmt.Sprintf("%v, max-age=%v, immutable", scope, int(time.Until(expires).Seconds())))
+	} else {
+		ctx.Set(fiber.HeaderCacheControl, scope+", no-cache")
+	}
+}
+
+// ifNoneMatch is list of ETags in If-None-Match, nil when there's none,
+// comparison is weak there, so W/ doesn't matter
+func ifNoneMatch(ctx *fiber.Ctx) []string {
+	header := strings.TrimSpace(ctx.Get(fiber.HeaderIfNoneMatch))
+	if header == "" {
+		return nil
+	}
+
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/"); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+
+	return etags
+}
+
+// ifMatch is list of ETags in If-Match, nil when any version will do
+func ifMatch(ctx *fiber.Ctx) []string {
+	header := strings.TrimSpace(ctx.Get(fiber.HeaderIfMatch))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		// weak ones never match, comparison is strong here
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+
+	return etags
+}
+
+// pasteBody is request body, or "file" or "content" field of a multipart form
+func pasteBody(ctx *fiber.Ctx) []byte {
+	if _, err := ctx.MultipartForm(); err != nil {
+		return ctx.Body()
+	}
+
+	file := uploaded(ctx)
+	if file == nil {
+		return []byte(formValue(ctx, "content"))
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+
+	return content
+}
+
+// uploaded is "file" field of a multipart form, nil when there's none
+func uploaded(ctx *fiber.Ctx) *multipart.FileHeader {
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		return nil
+	}
+
+	if files := form.File["file"]; len(files) > 0 {
+		return files[0]
+	}
+
+	return nil
+}
+
+// formValue only looks at multipart forms, curl sends raw pastes as
+// urlencoded ones and they must not be parsed
+func formValue(ctx *fiber.Ctx, key string) string {
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		return ""
+	}
+
+	if values := form.Value[key]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// password comes in X-Password or as basic auth password, username is ignored
+func password(ctx *fiber.Ctx) string {
+	if header := ctx.Get("X-Password"); header != "" {
+		return header
+	}
+
+	raw, ok := strings.CutPrefix(ctx.Get(fiber.HeaderAuthorization), "Basic ")
+	if !ok {
+		return ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return ""
+	}
+
+	_, password, _ := strings.Cut(string(decoded), ":")
+
+	return password
 }
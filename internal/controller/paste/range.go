@@ -0,0 +1,158 @@
+package paste
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/xbt573/barkpaste/internal/models"
+	pasteService "github.com/xbt573/barkpaste/internal/service/paste"
+)
+
+// more ranges than that are answered with whole content,
+// lots of tiny overlapping ones cost more than sending it
+const maxRanges = 16
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// byteRanges parses Range header against content of size, nil ranges mean
+// header is to be ignored, errUnsatisfiable means none of ranges is there
+func byteRanges(header string, size int64) ([]pasteService.Range, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+
+	var ranges []pasteService.Range
+
+	for _, spec := range specs {
+		first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok {
+			return nil, nil
+		}
+
+		// -N is last N bytes
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+
+			if n > 0 && size > 0 {
+				ranges = append(ranges, pasteService.Range{Start: max(size-n, 0), End: size})
+			}
+
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+
+		end := size
+		if last != "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < start {
+				return nil, nil
+			}
+
+			end = min(n+1, size)
+		}
+
+		if start < size {
+			ranges = append(ranges, pasteService.Range{Start: start, End: end})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+
+	return ranges, nil
+}
+
+// ifRange reports whether If-Range lets ranges be sent, ETags are compared
+// strongly and dates must be exactly Last-Modified
+func ifRange(ctx *fiber.Ctx, paste models.Paste) bool {
+	header := strings.TrimSpace(ctx.Get(fiber.HeaderIfRange))
+	if header == "" {
+		return true
+	}
+
+	if strings.HasPrefix(header, `"`) {
+		return header == paste.ETag()
+	}
+
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+
+	modified := paste.LastModified()
+
+	return !modified.IsZero() && modified.Truncate(time.Second).Equal(t)
+}
+
+// sendRanges answers with 206, content is ranges one after another,
+// several of them go in multipart/byteranges
+func sendRanges(ctx *fiber.Ctx, content []byte, ranges []pasteService.Range, size int64) error {
+	contentRange := func(r pasteService.Range) string {
+		return fmt.Sprintf("bytes %v-%v/%v", r.Start, r.End-1, size)
+	}
+
+	// paste could change since ranges were picked, then parts are shorter
+	part := func(r pasteService.Range) []byte {
+		n := min(r.End-r.Start, int64(len(content)))
+		p := content[:n]
+		content = content[n:]
+
+		return p
+	}
+
+	ctx.Status(fiber.StatusPartialContent)
+
+	if len(ranges) == 1 {
+		ctx.Set(fiber.HeaderContentRange, contentRange(ranges[0]))
+		return ctx.Send(part(ranges[0]))
+	}
+
+	contentType := string(ctx.Response().Header.ContentType())
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	for _, r := range ranges {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			fiber.HeaderContentType:  {contentType},
+			fiber.HeaderContentRange: {contentRange(r)},
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := pw.Write(part(r)); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, "multipart/byteranges; boundary="+w.Boundary())
+
+	return ctx.Send(body.Bytes())
+}
@@ -0,0 +1,355 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+// Edit is one line of a script turning a into b, A is index of line in a
+// (Equal and Delete), B is index in b (Equal and Insert)
+type Edit struct {
+	Op   Op
+	A, B int
+}
+
+// scripts longer than that are not searched for, see Compute
+const maxEdits = 2000
+
+// Lines splits content into lines, each keeps its newline,
+// so missing newline at the end is a difference too
+func Lines(content []byte) []string {
+	var lines []string
+
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			lines = append(lines, string(content))
+			break
+		}
+
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+
+	return lines
+}
+
+// Compute returns shortest edit script from a to b (Myers), when it's longer
+// than maxEdits after common prefix and suffix it gives up and replaces the
+// whole middle, still a valid script, just not the shortest
+func Compute(a, b []string) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]Edit, 0, len(a)+len(b))
+
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, Edit{Equal, i, i})
+	}
+
+	middle, ok := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if !ok {
+		middle = middle[:0]
+
+		for i := 0; i < len(a)-prefix-suffix; i++ {
+			middle = append(middle, Edit{Delete, i, 0})
+		}
+
+		for i := 0; i < len(b)-prefix-suffix; i++ {
+			middle = append(middle, Edit{Insert, 0, i})
+		}
+	}
+
+	for _, e := range middle {
+		edits = append(edits, Edit{e.Op, e.A + prefix, e.B + prefix})
+	}
+
+	for i := 0; i < suffix; i++ {
+		edits = append(edits, Edit{Equal, len(a) - suffix + i, len(b) - suffix + i})
+	}
+
+	return edits
+}
+
+func myers(a, b []string) ([]Edit, bool) {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxEdits)
+
+	// v[offset+k] is furthest x on diagonal k, trace keeps v of every step
+	// for k in [-d, d] to walk back from the end
+	offset := limit + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(trace, n, m, d), true
+			}
+		}
+
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	return nil, false
+}
+
+func backtrack(trace [][]int, n, m, d int) []Edit {
+	edits := make([]Edit, 0, n+m)
+	x, y := n, m
+
+	for ; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+
+		k := x - y
+
+		var prevK int
+		if k == -d || k != d && at(k-1) < at(k+1) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, Edit{Equal, x, y})
+		}
+
+		if x == prevX {
+			y--
+			edits = append(edits, Edit{Insert, x, y})
+		} else {
+			x--
+			edits = append(edits, Edit{Delete, x, y})
+		}
+	}
+
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, Edit{Equal, x, y})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+
+	return edits
+}
+
+// Unified formats edits like diff -u with context lines around changes,
+// empty when there are no changes
+func Unified(fromName, toName string, a, b []string, edits []Edit, context int) string {
+	var out strings.Builder
+
+	for _, h := range hunks(edits, context) {
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %v\n+++ %v\n", fromName, toName)
+		}
+
+		aStart, aLen, bStart, bLen := h.span(edits)
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", rangeOf(aStart, aLen), rangeOf(bStart, bLen))
+
+		for _, e := range edits[h.start:h.end] {
+			switch e.Op {
+			case Equal:
+				writeLine(&out, ' ', a[e.A])
+			case Delete:
+				writeLine(&out, '-', a[e.A])
+			case Insert:
+				writeLine(&out, '+', b[e.B])
+			}
+		}
+	}
+
+	return out.String()
+}
+
+type hunk struct {
+	start, end int
+}
+
+// span returns where hunk starts in a and b, 0 based, and how many lines it has
+func (h hunk) span(edits []Edit) (aStart, aLen, bStart, bLen int) {
+	aStart, bStart = -1, -1
+
+	for _, e := range edits[h.start:h.end] {
+		if e.Op != Insert {
+			if aStart < 0 {
+				aStart = e.A
+			}
+			aLen++
+		}
+
+		if e.Op != Delete {
+			if bStart < 0 {
+				bStart = e.B
+			}
+			bLen++
+		}
+	}
+
+	// side without lines starts where the other side's first edit is
+	first := edits[h.start]
+	if aStart < 0 {
+		aStart = first.A
+	}
+
+	if bStart < 0 {
+		bStart = first.B
+	}
+
+	return aStart, aLen, bStart, bLen
+}
+
+// hunks groups changes with context lines around them, close ones are merged
+func hunks(edits []Edit, context int) []hunk {
+	var result []hunk
+
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+
+		start := max(i-context, 0)
+
+		// extend while next change is within two contexts
+		end := i
+		for end < len(edits) {
+			if edits[end].Op != Equal {
+				end++
+				continue
+			}
+
+			next := end
+			for next < len(edits) && edits[next].Op == Equal {
+				next++
+			}
+
+			if next == len(edits) || next-end > 2*context {
+				break
+			}
+
+			end = next
+		}
+
+		end = min(end+context, len(edits))
+
+		if len(result) > 0 && result[len(result)-1].end >= start {
+			result[len(result)-1].end = end
+		} else {
+			result = append(result, hunk{start, end})
+		}
+
+		i = end
+	}
+
+	return result
+}
+
+// rangeOf is 1 based like diff, empty ranges point at line before them
+func rangeOf(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%v,0", start)
+	case 1:
+		return fmt.Sprintf("%v", start+1)
+	default:
+		return fmt.Sprintf("%v,%v", start+1, length)
+	}
+}
+
+func writeLine(out *strings.Builder, prefix byte, line string) {
+	out.WriteByte(prefix)
+	out.WriteString(line)
+
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// Row is a line of side by side view, A or B is -1 when that side has no line
+type Row struct {
+	A, B    int
+	Changed bool
+}
+
+// SideBySide pairs deleted and inserted lines of each change up,
+// so replaced lines end up next to their replacements
+func SideBySide(edits []Edit) []Row {
+	var (
+		rows              []Row
+		deleted, inserted []int
+	)
+
+	flush := func() {
+		for i := 0; i < max(len(deleted), len(inserted)); i++ {
+			row := Row{-1, -1, true}
+
+			if i < len(deleted) {
+				row.A = deleted[i]
+			}
+
+			if i < len(inserted) {
+				row.B = inserted[i]
+			}
+
+			rows = append(rows, row)
+		}
+
+		deleted, inserted = deleted[:0], inserted[:0]
+	}
+
+	for _, e := range edits {
+		switch e.Op {
+		case Equal:
+			flush()
+			rows = append(rows, Row{e.A, e.B, false})
+		case Delete:
+			deleted = append(deleted, e.A)
+		case Insert:
+			inserted = append(inserted, e.B)
+		}
+	}
+
+	flush()
+
+	return rows
+}
@@ -0,0 +1,96 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Version 1 is AES-256-GCM with a random 12 byte IV and no additional data,
+// viewer.html in controller decrypts the same format with WebCrypto
+const Version = 1
+
+// Envelope is what server stores for end-to-end encrypted pastes,
+// key never leaves clients, it travels in URL fragment
+type Envelope struct {
+	Version    int    `json:"v"`
+	IV         []byte `json:"iv"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// Seal encrypts content with a new key, returns envelope JSON and base64url key
+func Seal(content []byte) ([]byte, string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, "", err
+	}
+
+	envelope, err := json.Marshal(Envelope{
+		Version:    Version,
+		IV:         iv,
+		Ciphertext: aead.Seal(nil, iv, content, nil),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return envelope, base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func Open(envelope []byte, key string) ([]byte, error) {
+	var e Envelope
+	if err := json.Unmarshal(envelope, &e); err != nil {
+		return nil, fmt.Errorf("not an encrypted paste: %w", err)
+	}
+
+	if e.Version != Version {
+		return nil, fmt.Errorf("unsupported envelope version: %v", e.Version)
+	}
+
+	rawKey, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64url: %w", err)
+	}
+
+	aead, err := newAEAD(rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.IV) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid iv")
+	}
+
+	content, err := aead.Open(nil, e.IV, e.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong key or corrupted paste")
+	}
+
+	return content, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %v", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,211 @@
+package keyring
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// Keyring does envelope encryption: content is sealed with a random data key,
+// which is wrapped by a master key, only wrapped data keys are ever stored
+type Keyring interface {
+	// Active is ID of the master key new data keys are wrapped with,
+	// empty when encryption is off
+	Active() string
+
+	// Seal encrypts content with a new data key, aad is authenticated but not stored
+	Seal(content, aad []byte) (keyID string, wrapped, sealed []byte, err error)
+	Open(keyID string, wrapped, sealed, aad []byte) ([]byte, error)
+
+	// Rewrap rewraps data key with the active master key, content stays as is
+	Rewrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+type concreteKeyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// New takes master keys by ID, active may be empty to only decrypt
+func New(keys map[string][]byte, active string) (Keyring, error) {
+	k := &concreteKeyring{make(map[string]cipher.AEAD, len(keys)), active}
+
+	for id, key := range keys {
+		if id == "" {
+			return nil, fmt.Errorf("master key without id")
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("master key %v: %w", id, err)
+		}
+
+		k.keys[id] = aead
+	}
+
+	if _, ok := k.keys[active]; active != "" && !ok {
+		return nil, fmt.Errorf("active master key %v: %w", active, ErrUnknownKey)
+	}
+
+	return k, nil
+}
+
+// ReadFile reads "id base64-key" lines, # starts a comment
+func ReadFile(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected \"id key\"", path, line)
+		}
+
+		key, err := Decode(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+
+		keys[fields[0]] = key
+	}
+
+	return keys, scanner.Err()
+}
+
+// Decode parses base64 master key, standard or url alphabet
+func Decode(raw string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		key, err = base64.URLEncoding.DecodeString(raw)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("master key is not base64")
+	}
+
+	return key, nil
+}
+
+func (k *concreteKeyring) Active() string {
+	return k.active
+}
+
+func (k *concreteKeyring) Seal(content, aad []byte) (string, []byte, []byte, error) {
+	master, ok := k.keys[k.active]
+	if !ok {
+		return "", nil, nil, ErrUnknownKey
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, nil, err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	sealed, err := seal(data, content, aad)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// key ID is bound to wrapped key, so it can't be swapped for another
+	wrapped, err := seal(master, dataKey, []byte(k.active))
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return k.active, wrapped, sealed, nil
+}
+
+func (k *concreteKeyring) Open(keyID string, wrapped, sealed, aad []byte) ([]byte, error) {
+	dataKey, err := k.unwrap(keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(data, sealed, aad)
+}
+
+func (k *concreteKeyring) Rewrap(keyID string, wrapped []byte) ([]byte, error) {
+	master, ok := k.keys[k.active]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	dataKey, err := k.unwrap(keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(master, dataKey, []byte(k.active))
+}
+
+func (k *concreteKeyring) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	master, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, keyID)
+	}
+
+	return open(master, wrapped, []byte(keyID))
+}
+
+// newAEAD wants AES-256, shorter keys are most likely a config mistake
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %v", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal prepends random nonce to ciphertext
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
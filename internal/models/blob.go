@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Blob is paste content shared by every paste with the same SHA-256
+type Blob struct {
+	// hex SHA-256 of content
+	Digest   string `gorm:"primaryKey"`
+	RefCount int64
+	// size of content before compression
+	Size int64
+	// how stored bytes are compressed, see Encoding* constants
+	Encoding string
+
+	// key in blob storage, empty means same as Digest
+	Object string `gorm:"default:''"`
+	// master key that wrapped data key, empty for unencrypted blobs
+	KeyID      string `gorm:"index;default:''"`
+	WrappedKey []byte
+
+	// unreferenced blobs are only removed once this is old enough
+	UpdatedAt time.Time
+}
+
+const (
+	EncodingIdentity = ""
+	EncodingZstd     = "zstd"
+)
+
+func (b Blob) StorageKey() string {
+	if b.Object == "" {
+		return b.Digest
+	}
+
+	return b.Object
+}
@@ -1,10 +1,131 @@
 package models
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
 
 type Paste struct {
-	ID           string `gorm:"primaryKey"`
-	Content      []byte
+	ID string `gorm:"primaryKey"`
+
+	// content lives in blob storage, filled by service on reads
+	Content []byte `gorm:"-"`
+	// hex SHA-256 of content, see Blob
+	BlobKey string `gorm:"index"`
+	Size    int64
+	// same as blob's, Content is still compressed when set on a read
+	Encoding string
+	// master key of blob's data key, empty when stored unencrypted
+	KeyID string `gorm:"index;default:''"`
+	// as uploaded or detected, empty for pastes older than it
+	ContentType string `gorm:"default:''"`
+	// name of uploaded file, empty for raw pastes
+	Filename string `gorm:"default:''"`
+
+	// starts at 1, every content change makes a new one, see Revision
+	Revision uint `gorm:"default:1"`
+
 	IsPersistent bool
 	ExpiredAt    time.Time
+	// zero for pastes created before it was tracked
+	CreatedAt time.Time
+	// when content or its type last changed, zero like CreatedAt
+	ModifiedAt time.Time
+
+	// deleted by the first successful read
+	BurnAfterRead bool
+
+	// content is an envelope encrypted by client, server never has the key
+	Encrypted bool
+
+	// bcrypt, empty when paste is not password protected
+	PasswordHash []byte
+
+	Visibility Visibility `gorm:"default:'public'"`
+
+	// MaxViews == 0 means unlimited
+	MaxViews uint `gorm:"default:0"`
+	Views    uint `gorm:"default:0"`
+
+	// prefix of the token that created paste, empty for anonymous ones
+	TokenID string `gorm:"index"`
+
+	// anonymous pastes can be deleted with a key, only its hash is stored
+	DeleteKeyHash []byte
+	// set only on a freshly created paste
+	DeleteKey string `gorm:"-"`
+}
+
+// LastModified is when content was set, zero for pastes too old to know
+func (p Paste) LastModified() time.Time {
+	if p.ModifiedAt.IsZero() {
+		return p.CreatedAt
+	}
+
+	return p.ModifiedAt
+}
+
+// Counted reports whether reads of paste are counted, share links
+// can make them counted too
+func (p Paste) Counted() bool {
+	return p.BurnAfterRead || p.MaxViews > 0
+}
+
+// ETag changes with every revision, content is in it too, since revisions
+// start over when a named paste is created again, and so is content type,
+// it can change on its own. Pastes with counted reads get an opaque one,
+// digest would let anyone guess content without spending a read
+func (p Paste) ETag() string {
+	return p.EncodedETag(EncodingIdentity)
+}
+
+// EncodedETag is ETag of content sent in encoding, compressed bytes are
+// another representation and must not share validator with plain ones
+func (p Paste) EncodedETag(encoding string) string {
+	tag := fmt.Sprintf("%v-%v", p.Revision, p.BlobKey[:min(len(p.BlobKey), 16)])
+
+	if p.Counted() {
+		// every change moves Last-Modified by at least a second
+		sum := sha256.Sum256(fmt.Appendf(nil, "%v\n%v\n%v", p.ID, p.LastModified().Unix(), p.ContentType))
+		tag = fmt.Sprintf("%v-%v", p.Revision, hex.EncodeToString(sum[:8]))
+	} else if p.ContentType != "" {
+		// pastes older than stored types keep their tags
+		sum := sha256.Sum256([]byte(p.ContentType))
+		tag += "-" + hex.EncodeToString(sum[:4])
+	}
+
+	if encoding != "" && encoding != EncodingIdentity {
+		tag += "-" + encoding
+	}
+
+	return `"` + tag + `"`
+}
+
+// HasETag reports whether etag is one of paste's, in whatever encoding
+func (p Paste) HasETag(etag string) bool {
+	return etag == p.ETag() || etag == p.EncodedETag(EncodingZstd)
+}
+
+type Visibility string
+
+const (
+	VisibilityPublic Visibility = "public"
+	// same as public, but never listed or indexed
+	VisibilityUnlisted Visibility = "unlisted"
+	// readable only by owner and admins
+	VisibilityPrivate Visibility = "private"
+)
+
+// ParseVisibility treats empty as public
+func ParseVisibility(raw string) (Visibility, error) {
+	switch v := Visibility(raw); v {
+	case "":
+		return VisibilityPublic, nil
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown visibility: %v", raw)
+	}
 }
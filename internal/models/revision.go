@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Revision is a replaced version of paste content, it lives as long as paste
+type Revision struct {
+	PasteID string `gorm:"primaryKey"`
+	Number  uint   `gorm:"primaryKey;autoIncrement:false"`
+
+	// same as on Paste, revision holds a reference to blob too
+	BlobKey  string `gorm:"index"`
+	Size     int64
+	Encoding string
+	KeyID    string `gorm:"index;default:''"`
+	// same as on Paste
+	ContentType string `gorm:"default:''"`
+
+	// when this version was written
+	CreatedAt time.Time
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Share counts uses of a share link limited to MaxUses,
+// links without a limit are only signed and never stored
+type Share struct {
+	Nonce   string `gorm:"primaryKey"`
+	PasteID string `gorm:"index"`
+
+	MaxUses uint
+	Uses    uint
+
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -1,5 +1,108 @@
 package models
 
+import (
+	"database/sql/driver"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Token never holds the secret itself, only its salted and peppered hash
 type Token struct {
-	Token string `gorm:"primaryKey"`
+	// start of the secret, public and used for lookup
+	Prefix string `gorm:"primaryKey"`
+	Salt   []byte
+	Hash   []byte
+
+	Scopes Scopes `gorm:"type:text"`
+
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	// nil means token never expires
+	ExpiresAt *time.Time
+}
+
+type Scope string
+
+const (
+	ScopePasteRead   Scope = "paste:read"
+	ScopePasteCreate Scope = "paste:create"
+	ScopePasteUpdate Scope = "paste:update"
+	ScopePasteDelete Scope = "paste:delete"
+	ScopeTokenAdmin  Scope = "token:admin"
+)
+
+// AllScopes is what tokens had before scopes existed
+var AllScopes = Scopes{ScopePasteRead, ScopePasteCreate, ScopePasteUpdate, ScopePasteDelete, ScopeTokenAdmin}
+
+// Scopes is stored as a space separated string
+type Scopes []Scope
+
+// ParseScopes accepts scopes separated by spaces and/or commas
+func ParseScopes(raw string) (Scopes, error) {
+	var scopes Scopes
+
+	for _, field := range strings.FieldsFunc(raw, func(r rune) bool { return r == ' ' || r == ',' }) {
+		scope := Scope(field)
+		if !slices.Contains(AllScopes, scope) {
+			return nil, fmt.Errorf("unknown scope: %v", field)
+		}
+
+		if !scopes.Has(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+func (s Scopes) Has(scope Scope) bool {
+	return slices.Contains(s, scope)
+}
+
+// Contains reports whether s grants everything other does
+func (s Scopes) Contains(other Scopes) bool {
+	for _, scope := range other {
+		if !s.Has(scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Scopes) String() string {
+	parts := make([]string, len(s))
+	for i, scope := range s {
+		parts[i] = string(scope)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (s Scopes) Value() (driver.Value, error) {
+	return s.String(), nil
+}
+
+func (s *Scopes) Scan(value any) error {
+	var raw string
+
+	switch v := value.(type) {
+	case nil:
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("unsupported scopes type: %T", value)
+	}
+
+	*s = nil
+	for _, field := range strings.Fields(raw) {
+		*s = append(*s, Scope(field))
+	}
+
+	return nil
 }
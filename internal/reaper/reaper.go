@@ -0,0 +1,122 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	pasteService "github.com/xbt573/barkpaste/internal/service/paste"
+)
+
+type Reaper struct {
+	pasteService pasteService.Service
+	options      Options
+}
+
+type Options struct {
+	Interval  time.Duration
+	BatchSize int
+	Jitter    time.Duration
+
+	// orphaned blobs need a full storage listing, so it's done less often
+	OrphanInterval time.Duration
+}
+
+// blobs younger than that may belong to a paste being created
+const orphanGrace = time.Hour
+
+func New(pasteService pasteService.Service, opts Options) *Reaper {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	if opts.OrphanInterval <= 0 {
+		opts.OrphanInterval = time.Hour
+	}
+
+	return &Reaper{pasteService, opts}
+}
+
+// Run blocks until ctx is done, cleaning expired pastes every interval
+func (r *Reaper) Run(ctx context.Context) {
+	lastOrphans := time.Now()
+
+	for {
+		timer := time.NewTimer(r.next())
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		removed, err := r.sweep(ctx)
+		if err != nil {
+			slog.Error("failed to clean expired pastes", "err", err, "removed", removed)
+		} else if removed > 0 {
+			slog.Info("cleaned expired pastes", "removed", removed)
+		}
+
+		if time.Since(lastOrphans) < r.options.OrphanInterval {
+			continue
+		}
+
+		lastOrphans = time.Now()
+
+		removed, err = r.sweepOrphans()
+		if err != nil {
+			slog.Error("failed to clean orphaned blobs", "err", err, "removed", removed)
+		} else if removed > 0 {
+			slog.Info("cleaned orphaned blobs", "removed", removed)
+		}
+	}
+}
+
+func (r *Reaper) next() time.Duration {
+	if r.options.Jitter <= 0 {
+		return r.options.Interval
+	}
+
+	return r.options.Interval + rand.N(r.options.Jitter)
+}
+
+// sweep deletes expired pastes batch by batch until a batch comes back short
+func (r *Reaper) sweep(ctx context.Context) (removed int64, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		n, err := r.pasteService.CleanExpired(r.options.BatchSize)
+		removed += n
+
+		if err != nil {
+			return removed, err
+		}
+
+		if n < int64(r.options.BatchSize) {
+			break
+		}
+	}
+
+	return removed, nil
+}
+
+func (r *Reaper) sweepOrphans() (removed int64, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+
+	return r.pasteService.CleanOrphans(orphanGrace)
+}
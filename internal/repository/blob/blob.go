@@ -0,0 +1,21 @@
+package blob
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Repository keeps paste contents, database only has their keys
+type Repository interface {
+	Put(key string, content []byte) error
+	Get(key string) ([]byte, error)
+	// GetRange reads at most length bytes from offset, less near the end
+	GetRange(key string, offset, length int64) ([]byte, error)
+	// deleting missing blob is not an error
+	Delete(key string) error
+
+	// Walk calls fn for every stored blob, used to find orphans
+	Walk(fn func(key string, modified time.Time) error) error
+}
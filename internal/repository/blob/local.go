@@ -0,0 +1,127 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type localRepository struct {
+	dir string
+}
+
+// NewLocal stores blobs as files under dir, sharded by first key characters
+func NewLocal(dir string) (Repository, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &localRepository{dir}, nil
+}
+
+func (l *localRepository) path(key string) string {
+	if len(key) < 4 {
+		return filepath.Join(l.dir, key)
+	}
+
+	return filepath.Join(l.dir, key[:2], key[2:4], key)
+}
+
+func (l *localRepository) Put(key string, content []byte) error {
+	path := l.path(key)
+	dir := filepath.Dir(path)
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	// readers never see half written file, rename is atomic
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *localRepository) Get(key string) ([]byte, error) {
+	content, err := os.ReadFile(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return content, err
+}
+
+func (l *localRepository) GetRange(key string, offset, length int64) ([]byte, error) {
+	file, err := os.Open(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content := make([]byte, length)
+
+	n, err := file.ReadAt(content, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return content[:n], nil
+}
+
+func (l *localRepository) Delete(key string) error {
+	err := os.Remove(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (l *localRepository) Walk(fn func(key string, modified time.Time) error) error {
+	return filepath.WalkDir(l.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// unfinished writes are not blobs yet
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		return fn(d.Name(), info.ModTime())
+	})
+}
@@ -0,0 +1,353 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type S3Options struct {
+	// e.g. https://s3.eu-central-1.amazonaws.com or http://127.0.0.1:9000
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// bucket in path instead of host, needed by MinIO and friends
+	PathStyle bool
+	// prepended to keys, e.g. barkpaste/, so bucket can be shared,
+	// Walk only lists keys under it
+	Prefix string
+}
+
+type s3Repository struct {
+	endpoint *url.URL
+	options  S3Options
+	client   *http.Client
+}
+
+// NewS3 stores blobs as objects in an S3-compatible bucket
+func NewS3(opts S3Options) (Repository, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %v", opts.Endpoint)
+	}
+
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+
+	return &s3Repository{endpoint, opts, &http.Client{Timeout: time.Minute}}, nil
+}
+
+func (s *s3Repository) Put(key string, content []byte) error {
+	res, err := s.do(http.MethodPut, key, nil, nil, content)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+
+	return nil
+}
+
+func (s *s3Repository) Get(key string) ([]byte, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, s3Error(res)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func (s *s3Repository) GetRange(key string, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%v-%v", offset, offset+length-1)}}
+
+	res, err := s.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(io.LimitReader(res.Body, length))
+	case http.StatusOK:
+		// range was ignored, whole object is coming
+		if _, err := io.CopyN(io.Discard, res.Body, offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		return io.ReadAll(io.LimitReader(res.Body, length))
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, s3Error(res)
+	}
+}
+
+func (s *s3Repository) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// S3 says 204 for missing keys too, some implementations 404
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+
+	return nil
+}
+
+func (s *s3Repository) Walk(fn func(key string, modified time.Time) error) error {
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if s.options.Prefix != "" {
+			query.Set("prefix", s.options.Prefix)
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			err := s3Error(res)
+			res.Body.Close()
+			return err
+		}
+
+		var list struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range list.Contents {
+			key, ok := strings.CutPrefix(object.Key, s.options.Prefix)
+			if !ok {
+				continue
+			}
+
+			if err := fn(key, object.LastModified); err != nil {
+				return err
+			}
+		}
+
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return nil
+		}
+
+		token = list.NextContinuationToken
+	}
+}
+
+// do sends a request signed with AWS Signature Version 4,
+// key == "" is the bucket itself
+func (s *s3Repository) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	if key != "" {
+		key = s.options.Prefix + key
+	}
+
+	u := *s.endpoint
+	u.RawQuery = query.Encode()
+
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.options.PathStyle {
+		path += "/" + s.options.Bucket
+	} else {
+		u.Host = s.options.Bucket + "." + u.Host
+	}
+
+	u.Path = path + "/" + key
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	s.sign(req, body, time.Now())
+
+	return s.client.Do(req)
+}
+
+func (s *s3Repository) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.options.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.options.SecretKey), date)
+	key = hmacSHA256(key, s.options.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.options.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := slices.Clone(query[key])
+		slices.Sort(values)
+
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but unreserved characters, as SigV4 wants
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	var e struct {
+		Code    string
+		Message string
+	}
+
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: %v: %v: %v", res.Status, e.Code, e.Message)
+	}
+
+	return fmt.Errorf("s3: %v", res.Status)
+}
@@ -1,22 +1,71 @@
 package paste
 
 import (
+	"log/slog"
 	"time"
 
 	"github.com/xbt573/barkpaste/internal/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repository interface {
-	Create(paste models.Paste) (models.Paste, error)
+	// paste refers to blob, which is created if it's new
+	Create(paste models.Paste, blob models.Blob) (models.Paste, error)
 
 	List() ([]models.Paste, error)
 	GetByID(id string) (models.Paste, error)
+	// reads and deletes paste in one go, only one caller gets it
+	Take(id string) (models.Paste, error)
+	// counts a read, fails with gorm.ErrRecordNotFound when views are exhausted
+	View(id string) (models.Paste, error)
 
-	Update(paste models.Paste) (models.Paste, error)
+	// blob is only used when paste.BlobKey changes, replaced content
+	// is kept as a revision then, fails with gorm.ErrDuplicatedKey when
+	// paste was changed concurrently. With match it's only updated while
+	// it has match's revision, content and type, fails with gorm.ErrRecordNotFound
+	// otherwise. View counters are never written, View owns them
+	Update(paste models.Paste, blob models.Blob, match *models.Paste) (models.Paste, error)
 
-	Delete(id string) (models.Paste, error)
-	CleanExpired() error
+	// previous versions of paste, oldest first, current one is not there
+	Revisions(pasteID string) ([]models.Revision, error)
+	GetRevision(pasteID string, number uint) (models.Revision, error)
+
+	// match is same as in Update
+	Delete(id string, match *models.Paste) (models.Paste, error)
+	// removes at most limit expired non-persistent pastes and used up ones,
+	// returns them
+	CleanExpired(limit int) ([]models.Paste, error)
+
+	// TouchBlob returns blob and whether it is known, protecting it from
+	// DeleteUnusedBlobs for a while, so it can be referenced without upload
+	TouchBlob(digest string) (models.Blob, bool, error)
+	GetBlob(digest string) (models.Blob, error)
+	// DeleteUnusedBlobs removes rows of at most limit blobs nobody refers to
+	// since before and returns them, their objects are left to the caller
+	DeleteUnusedBlobs(before time.Time, limit int) ([]models.Blob, error)
+	// returns those of storage keys that belong to known blobs
+	UsedBlobKeys(keys []string) ([]string, error)
+
+	// StaleBlobs returns at most limit blobs after digest not under master key keyID
+	StaleBlobs(keyID, after string, limit int) ([]models.Blob, error)
+	// RekeyBlob replaces storage key and data key of blob unless it changed
+	// since it was read, fails with gorm.ErrRecordNotFound then
+	RekeyBlob(old, rekeyed models.Blob) error
+
+	CreateShare(share models.Share) error
+	// UseShare counts a use of share, fails with gorm.ErrRecordNotFound
+	// when it's used up or gone
+	UseShare(nonce string) error
+	// removes at most limit expired shares
+	CleanShares(limit int) (int64, error)
+
+	// MigrateContent moves content stored inline by older versions out of
+	// the table, move stores content elsewhere and returns its blob
+	MigrateContent(move func(content []byte) (models.Blob, error)) error
+	// MigrateBlobs gives pastes stored before deduplication a blob,
+	// rekey stores their content by digest and returns the blob
+	MigrateBlobs(rekey func(paste models.Paste) (models.Blob, error)) error
 }
 
 type concreteRepository struct {
@@ -24,28 +73,56 @@ type concreteRepository struct {
 }
 
 func New(db *gorm.DB) (Repository, error) {
-	if err := db.AutoMigrate(&models.Paste{}); err != nil {
+	if err := db.AutoMigrate(&models.Paste{}, &models.Blob{}, &models.Share{}, &models.Revision{}); err != nil {
+		return nil, err
+	}
+
+	// columns were once added without default, NULL never passes view checks
+	err := db.Model(&models.Paste{}).
+		Where("views IS NULL OR max_views IS NULL").
+		UpdateColumns(map[string]any{
+			"views":     gorm.Expr("COALESCE(views, 0)"),
+			"max_views": gorm.Expr("COALESCE(max_views, 0)"),
+		}).Error
+	if err != nil {
 		return nil, err
 	}
 
 	return &concreteRepository{db}, nil
 }
 
-func (c *concreteRepository) Create(paste models.Paste) (models.Paste, error) {
-	result := c.db.Create(&paste)
+func (c *concreteRepository) Create(paste models.Paste, blob models.Blob) (models.Paste, error) {
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		if err := acquire(tx, blob); err != nil {
+			return err
+		}
 
-	return paste, result.Error
+		return tx.Create(&paste).Error
+	})
+
+	return paste, err
 }
 
-func (c *concreteRepository) Delete(id string) (models.Paste, error) {
-	var paste models.Paste
+func (c *concreteRepository) Delete(id string, match *models.Paste) (models.Paste, error) {
+	var pastes []models.Paste
 
-	result := c.db.Where("id = ?", id).Delete(&paste)
-	if result.RowsAffected == 0 {
-		return paste, gorm.ErrRecordNotFound
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		result := matching(tx.Clauses(clause.Returning{}), match).Where("id = ?", id).Delete(&pastes)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(pastes) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return release(tx, pastes)
+	})
+	if err != nil {
+		return models.Paste{}, err
 	}
 
-	return paste, result.Error
+	return pastes[0], nil
 }
 
 func (c *concreteRepository) GetByID(id string) (models.Paste, error) {
@@ -56,6 +133,47 @@ func (c *concreteRepository) GetByID(id string) (models.Paste, error) {
 	return paste, result.Error
 }
 
+func (c *concreteRepository) Take(id string) (models.Paste, error) {
+	var pastes []models.Paste
+
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		// DELETE ... RETURNING, so concurrent readers can't both see the row
+		result := tx.Clauses(clause.Returning{}).Where("id = ?", id).Delete(&pastes)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(pastes) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return release(tx, pastes)
+	})
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	return pastes[0], nil
+}
+
+func (c *concreteRepository) View(id string) (models.Paste, error) {
+	var pastes []models.Paste
+
+	result := c.db.Model(&pastes).
+		Clauses(clause.Returning{}).
+		Where("id = ? AND (max_views = 0 OR views < max_views)", id).
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if result.Error != nil {
+		return models.Paste{}, result.Error
+	}
+
+	if len(pastes) == 0 {
+		return models.Paste{}, gorm.ErrRecordNotFound
+	}
+
+	return pastes[0], nil
+}
+
 func (c *concreteRepository) List() ([]models.Paste, error) {
 	var pastes []models.Paste
 
@@ -64,13 +182,394 @@ func (c *concreteRepository) List() ([]models.Paste, error) {
 	return pastes, result.Error
 }
 
-func (c *concreteRepository) Update(paste models.Paste) (models.Paste, error) {
-	result := c.db.Model(&paste).Updates(paste)
+func (c *concreteRepository) Update(paste models.Paste, blob models.Blob, match *models.Paste) (models.Paste, error) {
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		var current models.Paste
 
-	return paste, result.Error
+		if err := matching(tx, match).Where("id = ?", paste.ID).First(&current).Error; err != nil {
+			return err
+		}
+
+		if current.BlobKey != paste.BlobKey {
+			// revision takes over the reference current content had,
+			// a concurrent update makes the same revision and fails here
+			err := tx.Create(&models.Revision{
+				PasteID:     current.ID,
+				Number:      max(current.Revision, 1),
+				BlobKey:     current.BlobKey,
+				Size:        current.Size,
+				Encoding:    current.Encoding,
+				KeyID:       current.KeyID,
+				ContentType: current.ContentType,
+				CreatedAt:   current.LastModified(),
+			}).Error
+			if err != nil {
+				return err
+			}
+
+			if err := acquire(tx, blob); err != nil {
+				return err
+			}
+
+			paste.Revision = max(current.Revision, 1) + 1
+
+			// Updates skips zero values, identity encoding and no key are ones
+			err = tx.Model(&paste).Updates(map[string]any{
+				"encoding": paste.Encoding,
+				"key_id":   paste.KeyID,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// checked again by the update itself, row could change after it was read,
+		// views are counted meanwhile and paste has them as they were then
+		result := matching(tx.Model(&paste), match).Omit("views", "max_views").Updates(paste)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return nil
+	})
+
+	return paste, err
+}
+
+// matching limits query to match's version of paste, see Update
+func matching(tx *gorm.DB, match *models.Paste) *gorm.DB {
+	if match == nil {
+		return tx
+	}
+
+	// content type is in ETag as well, it can change without a new revision
+	return tx.Where("revision = ? AND blob_key = ? AND content_type = ?", match.Revision, match.BlobKey, match.ContentType)
+}
+
+func (c *concreteRepository) Revisions(pasteID string) ([]models.Revision, error) {
+	var revisions []models.Revision
+
+	result := c.db.Where("paste_id = ?", pasteID).Order("number").Find(&revisions)
+
+	return revisions, result.Error
+}
+
+func (c *concreteRepository) GetRevision(pasteID string, number uint) (models.Revision, error) {
+	var revision models.Revision
+
+	result := c.db.Where("paste_id = ? AND number = ?", pasteID, number).First(&revision)
+
+	return revision, result.Error
+}
+
+func (c *concreteRepository) CleanExpired(limit int) ([]models.Paste, error) {
+	var pastes []models.Paste
+
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		expired := tx.Model(&models.Paste{}).
+			Select("id").
+			// persistent pastes are never removed for time, only used up ones
+			Where("(expired_at < ? AND is_persistent = ?) OR (max_views > 0 AND views >= max_views)", time.Now(), false).
+			Limit(limit)
+
+		result := tx.Clauses(clause.Returning{}).Where("id IN (?)", expired).Delete(&pastes)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return release(tx, pastes)
+	})
+
+	return pastes, err
+}
+
+func (c *concreteRepository) TouchBlob(digest string) (models.Blob, bool, error) {
+	var blobs []models.Blob
+
+	result := c.db.Model(&blobs).
+		Clauses(clause.Returning{}).
+		Where("digest = ?", digest).
+		Update("updated_at", time.Now())
+	if result.Error != nil || len(blobs) == 0 {
+		return models.Blob{}, false, result.Error
+	}
+
+	return blobs[0], true, nil
 }
 
-func (c *concreteRepository) CleanExpired() error {
-	result := c.db.Where("expired_at < ? AND is_persistent = ?", time.Now(), false).Delete(&models.Paste{})
-	return result.Error
+func (c *concreteRepository) GetBlob(digest string) (models.Blob, error) {
+	var blob models.Blob
+
+	result := c.db.Where("digest = ?", digest).First(&blob)
+
+	return blob, result.Error
+}
+
+func (c *concreteRepository) DeleteUnusedBlobs(before time.Time, limit int) ([]models.Blob, error) {
+	var blobs []models.Blob
+
+	unused := c.db.Model(&models.Blob{}).
+		Select("digest").
+		Where("ref_count <= 0 AND updated_at < ?", before).
+		Limit(limit)
+
+	result := c.db.Clauses(clause.Returning{}).Where("digest IN (?)", unused).Delete(&blobs)
+
+	return blobs, result.Error
+}
+
+func (c *concreteRepository) UsedBlobKeys(keys []string) ([]string, error) {
+	var blobs []models.Blob
+
+	result := c.db.
+		Select("digest", "object").
+		Where("object IN ? OR (object = '' AND digest IN ?)", keys, keys).
+		Find(&blobs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	used := make([]string, len(blobs))
+	for i, blob := range blobs {
+		used[i] = blob.StorageKey()
+	}
+
+	return used, nil
+}
+
+func (c *concreteRepository) StaleBlobs(keyID, after string, limit int) ([]models.Blob, error) {
+	var blobs []models.Blob
+
+	result := c.db.
+		Where("key_id <> ? AND digest > ?", keyID, after).
+		Order("digest").
+		Limit(limit).
+		Find(&blobs)
+
+	return blobs, result.Error
+}
+
+func (c *concreteRepository) RekeyBlob(old, rekeyed models.Blob) error {
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Blob{}).
+			Where("digest = ? AND key_id = ? AND object = ?", old.Digest, old.KeyID, old.Object).
+			Updates(map[string]any{
+				"object":      rekeyed.Object,
+				"key_id":      rekeyed.KeyID,
+				"wrapped_key": rekeyed.WrappedKey,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// pastes only mirror key ID, it's what tells which ones a key protects
+		err := tx.Model(&models.Paste{}).
+			Where("blob_key = ?", old.Digest).
+			UpdateColumn("key_id", rekeyed.KeyID).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Revision{}).
+			Where("blob_key = ?", old.Digest).
+			UpdateColumn("key_id", rekeyed.KeyID).Error
+	})
+}
+
+func (c *concreteRepository) CreateShare(share models.Share) error {
+	return c.db.Create(&share).Error
+}
+
+func (c *concreteRepository) UseShare(nonce string) error {
+	result := c.db.Model(&models.Share{}).
+		Where("nonce = ? AND uses < max_uses AND expires_at > ?", nonce, time.Now()).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (c *concreteRepository) CleanShares(limit int) (int64, error) {
+	expired := c.db.Model(&models.Share{}).
+		Select("nonce").
+		Where("expires_at < ?", time.Now()).
+		Limit(limit)
+
+	result := c.db.Where("nonce IN (?)", expired).Delete(&models.Share{})
+
+	return result.RowsAffected, result.Error
+}
+
+func (c *concreteRepository) MigrateContent(move func(content []byte) (models.Blob, error)) error {
+	if !c.db.Migrator().HasColumn(&models.Paste{}, "content") {
+		return nil
+	}
+
+	for {
+		var legacy []struct {
+			ID      string
+			Content []byte
+		}
+
+		result := c.db.Table("pastes").
+			Select("id", "content").
+			Where("content IS NOT NULL").
+			Limit(100).
+			Find(&legacy)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(legacy) == 0 {
+			break
+		}
+
+		for _, l := range legacy {
+			blob, err := move(l.Content)
+			if err != nil {
+				return err
+			}
+
+			err = c.db.Transaction(func(tx *gorm.DB) error {
+				if err := acquire(tx, blob); err != nil {
+					return err
+				}
+
+				return tx.Table("pastes").Where("id = ?", l.ID).Updates(map[string]any{
+					"blob_key": blob.Digest,
+					"size":     blob.Size,
+					"encoding": blob.Encoding,
+					"key_id":   blob.KeyID,
+					"content":  nil,
+				}).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		slog.Info("moved inline content to blob storage", "count", len(legacy))
+	}
+
+	if err := c.db.Migrator().DropColumn(&models.Paste{}, "content"); err != nil {
+		return err
+	}
+
+	// sqlite recreates the table to drop a column, losing indexes
+	return c.db.AutoMigrate(&models.Paste{})
+}
+
+func (c *concreteRepository) MigrateBlobs(rekey func(paste models.Paste) (models.Blob, error)) error {
+	last := ""
+
+	for {
+		var pastes []models.Paste
+
+		result := c.db.
+			Where("id > ? AND blob_key NOT IN (?)", last, c.db.Model(&models.Blob{}).Select("digest")).
+			Order("id").
+			Limit(100).
+			Find(&pastes)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(pastes) == 0 {
+			return nil
+		}
+
+		for _, paste := range pastes {
+			last = paste.ID
+
+			blob, err := rekey(paste)
+			if err != nil {
+				return err
+			}
+
+			err = c.db.Transaction(func(tx *gorm.DB) error {
+				if err := acquire(tx, blob); err != nil {
+					return err
+				}
+
+				return tx.Model(&paste).Updates(map[string]any{
+					"blob_key": blob.Digest,
+					"encoding": blob.Encoding,
+					"key_id":   blob.KeyID,
+				}).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		slog.Info("moved pastes to deduplicated blobs", "count", len(pastes))
+	}
+}
+
+// acquire adds a reference to blob, creating it if needed
+func acquire(tx *gorm.DB, blob models.Blob) error {
+	blob.RefCount = 1
+	blob.UpdatedAt = time.Now()
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "digest"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"ref_count":  gorm.Expr("blobs.ref_count + 1"),
+			"updated_at": blob.UpdatedAt,
+		}),
+	}).Create(&blob).Error
+}
+
+// release drops references of deleted pastes and deletes their revisions,
+// blobs stay until DeleteUnusedBlobs
+func release(tx *gorm.DB, pastes []models.Paste) error {
+	if len(pastes) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(pastes))
+	digests := make([]string, len(pastes))
+
+	for i, paste := range pastes {
+		ids[i] = paste.ID
+		digests[i] = paste.BlobKey
+	}
+
+	var revisions []models.Revision
+
+	result := tx.Clauses(clause.Returning{}).Where("paste_id IN ?", ids).Delete(&revisions)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, revision := range revisions {
+		digests = append(digests, revision.BlobKey)
+	}
+
+	// one decrement per reference, same digest may be there more than once
+	for _, digest := range digests {
+		result := tx.Model(&models.Blob{}).Where("digest = ?", digest).Updates(map[string]any{
+			"ref_count":  gorm.Expr("ref_count - 1"),
+			"updated_at": time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,166 @@
+package paste
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xbt573/barkpaste/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "db.sqlite")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func newRepository(t *testing.T) Repository {
+	repo, err := New(openDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo
+}
+
+func testBlob(content string) models.Blob {
+	sum := sha256.Sum256([]byte(content))
+
+	return models.Blob{Digest: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+}
+
+func createPaste(t *testing.T, repo Repository, paste models.Paste) models.Paste {
+	blob := testBlob(paste.ID)
+	paste.BlobKey = blob.Digest
+
+	paste, err := repo.Create(paste, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return paste
+}
+
+// pastes made before views were counted must still be readable
+func TestViewLegacyPaste(t *testing.T) {
+	db := openDB(t)
+
+	// schema and row as the first release left them
+	err := db.Exec("CREATE TABLE pastes (id text, content blob, is_persistent numeric, expired_at datetime, PRIMARY KEY (id))").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Exec("INSERT INTO pastes VALUES (?, ?, ?, ?)", "legacy", []byte("hello"), false, time.Now().Add(time.Hour)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.MigrateContent(func(content []byte) (models.Blob, error) {
+		return testBlob(string(content)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paste, err := repo.View("legacy")
+	if err != nil {
+		t.Fatalf("view of legacy paste: %v", err)
+	}
+
+	if paste.Views != 1 || paste.MaxViews != 0 {
+		t.Fatalf("views = %v, max views = %v, want 1 and 0", paste.Views, paste.MaxViews)
+	}
+}
+
+// databases upgraded while the columns had no default have NULL in them
+func TestViewNullViews(t *testing.T) {
+	db := openDB(t)
+
+	repo, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createPaste(t, repo, models.Paste{ID: "upgraded", ExpiredAt: time.Now().Add(time.Hour)})
+
+	if err := db.Exec("UPDATE pastes SET views = NULL, max_views = NULL").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.View("upgraded"); err != nil {
+		t.Fatalf("view of upgraded paste: %v", err)
+	}
+}
+
+// update of a paste read before a view must not bring back its old count
+func TestUpdateKeepsViews(t *testing.T) {
+	repo := newRepository(t)
+
+	createPaste(t, repo, models.Paste{ID: "limited", MaxViews: 2, ExpiredAt: time.Now().Add(time.Hour)})
+
+	if _, err := repo.View("limited"); err != nil {
+		t.Fatal(err)
+	}
+
+	paste, err := repo.GetByID("limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.View("limited"); err != nil {
+		t.Fatal(err)
+	}
+
+	paste.ContentType = "text/plain; charset=utf-8"
+
+	if _, err := repo.Update(paste, models.Blob{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.View("limited"); err == nil {
+		t.Fatal("third view of paste limited to two succeeded")
+	}
+}
+
+func TestCleanExpiredKeepsPersistent(t *testing.T) {
+	repo := newRepository(t)
+
+	past := time.Now().Add(-time.Hour)
+
+	createPaste(t, repo, models.Paste{ID: "regular", ExpiredAt: past})
+	createPaste(t, repo, models.Paste{ID: "named", IsPersistent: true, ExpiredAt: past})
+
+	removed, err := repo.CleanExpired(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0].ID != "regular" {
+		t.Fatalf("removed %v, want only regular paste", removed)
+	}
+
+	if _, err := repo.GetByID("named"); err != nil {
+		t.Fatalf("persistent paste: %v", err)
+	}
+}
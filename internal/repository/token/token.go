@@ -1,28 +1,45 @@
 package token
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/xbt573/barkpaste/internal/models"
 	"gorm.io/gorm"
 )
 
 type Repository interface {
-	Create(token models.Token) (models.Token, error)
+	// secret is hashed, token only carries metadata
+	Create(secret string, token models.Token) (models.Token, error)
 	List() ([]models.Token, error)
-	Delete(token string) error
-	Exists(token string) (bool, error)
+	// expired tokens are not found, found ones are marked as used
+	Get(secret string) (models.Token, error)
+	Delete(prefix string) error
 }
 
 type Options struct {
-	Token string
+	Token  string
+	Pepper string
 }
 
 type concreteRepository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	pepper []byte
 }
 
 func New(db *gorm.DB, opts Options) (Repository, error) {
+	r := &concreteRepository{db, []byte(opts.Pepper)}
+
+	if db.Migrator().HasColumn("tokens", "token") {
+		if err := r.migrateLegacy(); err != nil {
+			return nil, fmt.Errorf("failed to migrate plaintext tokens: %w", err)
+		}
+	}
+
 	if err := db.AutoMigrate(&models.Token{}); err != nil {
 		return nil, err
 	}
@@ -33,17 +50,66 @@ func New(db *gorm.DB, opts Options) (Repository, error) {
 	}
 
 	if count == 0 {
-		if err := db.Create(&models.Token{Token: opts.Token}).Error; err != nil {
+		if _, err := r.Create(opts.Token, models.Token{Name: "default", Scopes: models.AllScopes}); err != nil {
 			return nil, err
 		}
 
 		slog.Info("created default token from config, please replace it")
 	}
 
-	return &concreteRepository{db}, nil
+	return r, nil
 }
 
-func (r *concreteRepository) Create(token models.Token) (models.Token, error) {
+// migrateLegacy replaces plaintext tokens with hashed ones
+func (r *concreteRepository) migrateLegacy() error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var legacy []struct {
+			Token  string
+			Scopes models.Scopes
+		}
+
+		if err := tx.Table("tokens").Find(&legacy).Error; err != nil {
+			return err
+		}
+
+		// recreated instead of renamed, postgres would keep the old pkey index name
+		if err := tx.Migrator().DropTable("tokens"); err != nil {
+			return err
+		}
+
+		if err := tx.AutoMigrate(&models.Token{}); err != nil {
+			return err
+		}
+
+		for _, l := range legacy {
+			scopes := l.Scopes
+			if len(scopes) == 0 {
+				// tokens created before scopes existed could do everything
+				scopes = models.AllScopes
+			}
+
+			token, err := r.hash(l.Token, models.Token{Scopes: scopes})
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Create(&token).Error; err != nil {
+				return fmt.Errorf("token %v: %w", token.Prefix, err)
+			}
+		}
+
+		slog.Info("hashed plaintext tokens", "count", len(legacy))
+
+		return nil
+	})
+}
+
+func (r *concreteRepository) Create(secret string, token models.Token) (models.Token, error) {
+	token, err := r.hash(secret, token)
+	if err != nil {
+		return models.Token{}, err
+	}
+
 	result := r.db.Create(&token)
 
 	return token, result.Error
@@ -52,13 +118,41 @@ func (r *concreteRepository) Create(token models.Token) (models.Token, error) {
 func (r *concreteRepository) List() ([]models.Token, error) {
 	var tokens []models.Token
 
-	result := r.db.Find(&tokens)
+	result := r.db.Order("created_at").Find(&tokens)
 
 	return tokens, result.Error
 }
 
-func (r *concreteRepository) Delete(token string) error {
-	result := r.db.Delete(&models.Token{}, "token = ?", token)
+func (r *concreteRepository) Get(secret string) (models.Token, error) {
+	var token models.Token
+
+	result := r.db.Where("prefix = ?", prefix(secret)).First(&token)
+	if result.Error != nil {
+		return models.Token{}, result.Error
+	}
+
+	if !hmac.Equal(token.Hash, r.digest(token.Salt, secret)) {
+		return models.Token{}, gorm.ErrRecordNotFound
+	}
+
+	now := time.Now()
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return models.Token{}, gorm.ErrRecordNotFound
+	}
+
+	// a write per request is too much, minute precision is enough
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		result := r.db.Model(&token).UpdateColumn("last_used_at", now)
+		if result.Error != nil {
+			return models.Token{}, result.Error
+		}
+	}
+
+	return token, nil
+}
+
+func (r *concreteRepository) Delete(prefix string) error {
+	result := r.db.Delete(&models.Token{}, "prefix = ?", prefix)
 	if result.RowsAffected == 0 {
 		return gorm.ErrRecordNotFound
 	}
@@ -66,10 +160,28 @@ func (r *concreteRepository) Delete(token string) error {
 	return result.Error
 }
 
-func (r *concreteRepository) Exists(token string) (bool, error) {
-	var count int64
+func (r *concreteRepository) hash(secret string, token models.Token) (models.Token, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return models.Token{}, err
+	}
+
+	token.Prefix = prefix(secret)
+	token.Salt = salt
+	token.Hash = r.digest(salt, secret)
 
-	result := r.db.Model(&models.Token{}).Where("token = ?", token).Count(&count)
+	return token, nil
+}
+
+func (r *concreteRepository) digest(salt []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, r.pepper)
+	mac.Write(salt)
+	mac.Write([]byte(secret))
+
+	return mac.Sum(nil)
+}
 
-	return count > 0, result.Error
+// prefix never covers more than half of the secret, short tokens included
+func prefix(secret string) string {
+	return secret[:min(8, len(secret)/2)]
 }
@@ -0,0 +1,70 @@
+package paste
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// wrong passwords allowed per paste per window
+	maxAttempts   = 5
+	attemptWindow = time.Minute
+)
+
+// attempts counts wrong passwords per paste, in memory, so every instance
+// of a cluster has its own limit
+type attempts struct {
+	mu       sync.Mutex
+	failures map[string]*window
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+func newAttempts() *attempts {
+	return &attempts{failures: make(map[string]*window)}
+}
+
+// reserve counts a guess at id before it's checked, so concurrent guesses
+// can't all slip in before first failure is recorded, false if none are left
+func (a *attempts) reserve(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+
+	w, ok := a.failures[id]
+	if !ok || now.Sub(w.start) > attemptWindow {
+		// forget finished windows once in a while, so map doesn't grow forever
+		if len(a.failures) > 10000 {
+			for id, w := range a.failures {
+				if now.Sub(w.start) > attemptWindow {
+					delete(a.failures, id)
+				}
+			}
+		}
+
+		w = &window{start: now}
+		a.failures[id] = w
+	}
+
+	if w.count >= maxAttempts {
+		return false
+	}
+
+	w.count++
+
+	return true
+}
+
+// refund gives back guess reserved at id, right password isn't a failure
+func (a *attempts) refund(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if w, ok := a.failures[id]; ok && w.count > 0 {
+		w.count--
+	}
+}
@@ -0,0 +1,40 @@
+package paste
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/xbt573/barkpaste/internal/models"
+)
+
+// both are safe for concurrent EncodeAll/DecodeAll
+var (
+	encoder, _ = zstd.NewWriter(nil)
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// compress returns content as it should be stored and its encoding,
+// content is kept as is when small or when compression doesn't help
+func compress(content []byte, threshold int) ([]byte, string) {
+	if threshold <= 0 || len(content) < threshold {
+		return content, models.EncodingIdentity
+	}
+
+	compressed := encoder.EncodeAll(content, make([]byte, 0, len(content)/2))
+	if len(compressed) >= len(content) {
+		return content, models.EncodingIdentity
+	}
+
+	return compressed, models.EncodingZstd
+}
+
+func decompress(stored []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case models.EncodingIdentity:
+		return stored, nil
+	case models.EncodingZstd:
+		return decoder.DecodeAll(stored, nil)
+	default:
+		return nil, fmt.Errorf("unknown encoding: %v", encoding)
+	}
+}
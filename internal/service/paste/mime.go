@@ -0,0 +1,96 @@
+package paste
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Go only knows a few extensions itself, the rest depends on mime.types
+// of the system, these are common in pastes and shouldn't
+var textTypes = map[string]string{
+	".txt":   "text/plain; charset=utf-8",
+	".log":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".diff":  "text/x-diff; charset=utf-8",
+	".patch": "text/x-diff; charset=utf-8",
+	".yaml":  "application/yaml",
+	".yml":   "application/yaml",
+	".toml":  "application/toml",
+	".go":    "text/x-go; charset=utf-8",
+	".py":    "text/x-python; charset=utf-8",
+	".sh":    "text/x-shellscript; charset=utf-8",
+	".c":     "text/x-c; charset=utf-8",
+	".h":     "text/x-c; charset=utf-8",
+	".rs":    "text/x-rust; charset=utf-8",
+	".sql":   "application/sql",
+}
+
+// detectType is declared type if it's valid, or one from extension of
+// name, or sniffed from content
+func detectType(declared, name string, content []byte) string {
+	if contentType := parseType(declared); contentType != "" {
+		return contentType
+	}
+
+	if ext := strings.ToLower(path.Ext(name)); ext != "" {
+		if contentType, ok := textTypes[ext]; ok {
+			return contentType
+		}
+
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+
+	// sniffing says text/plain for JSON
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return "application/json"
+	}
+
+	return http.DetectContentType(content)
+}
+
+// parseType normalizes content type, empty when it's not valid
+func parseType(raw string) string {
+	if raw == "" {
+		return ""
+	}
+
+	mediatype, params, err := mime.ParseMediaType(raw)
+	if err != nil {
+		return ""
+	}
+
+	return mime.FormatMediaType(mediatype, params)
+}
+
+// cleanFilename is base name of uploaded file without anything that
+// could break a header, at most 255 bytes
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+
+		return r
+	}, name)
+
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	return name
+}
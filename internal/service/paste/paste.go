@@ -1,12 +1,23 @@
 package paste
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/xbt573/barkpaste/internal/keyring"
 	"github.com/xbt573/barkpaste/internal/models"
+	"github.com/xbt573/barkpaste/internal/repository/blob"
 	"github.com/xbt573/barkpaste/internal/repository/paste"
 	"github.com/xbt573/barkpaste/internal/repository/token"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 
 	nanoid "github.com/matoous/go-nanoid/v2"
@@ -17,22 +28,60 @@ var (
 	ErrExists         = errors.New("already exists")
 	ErrTooBig         = errors.New("too big")
 	ErrUnauthorized   = errors.New("unauthorized")
+	ErrForbidden      = errors.New("forbidden")
 	ErrInvalidRequest = errors.New("invalid request")
+	// too many wrong passwords for paste, try later
+	ErrTooManyAttempts = errors.New("too many attempts")
+	// paste isn't the version caller expected anymore
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// cached copy of caller is still fresh, see GetOptions
+	ErrNotModified = errors.New("not modified")
 )
 
 type Service interface {
 	// token == "" is fine
-	CreateRegular(token string, content []byte, userTTL time.Duration) (models.Paste, error)
-	CreatePersistent(token, name string, content []byte, userTTL time.Duration) (models.Paste, error)
+	CreateRegular(token string, content []byte, userTTL time.Duration, opts CreateOptions) (models.Paste, error)
+	CreatePersistent(token, name string, content []byte, userTTL time.Duration, opts CreateOptions) (models.Paste, error)
 
-	Get(id string) (models.Paste, error)
+	// NOTE: Get counts as a read, burn-after-read pastes are gone after it
+	// private pastes are not found without a token that can read them
+	Get(token, id string, opts GetOptions) (models.Paste, error)
+	// Stat is Get without content, it doesn't count a read and ignores
+	// opts.Encodings and opts.Ranges, password is checked like in Get
+	Stat(token, id string, opts GetOptions) (models.Paste, error)
+	// Peek returns paste without content and without counting a read,
+	// share is a share link value, it's an alternative to token
+	Peek(token, id, share string) (models.Paste, error)
+	// Counted reports whether Get of paste spends something, a view or
+	// whole burn-after-read paste, or a use of share link, without reading it
+	Counted(token, id, share string) (bool, error)
+	// Revisions lists versions of paste, oldest first and current last,
+	// readable like paste itself, but without counting a read
+	Revisions(token, id string, opts GetOptions) ([]models.Revision, error)
+	// Share mints a signed read link for paste, returns ?share= value
+	// and when it expires, only owner and admins can share
+	Share(token, id string, opts ShareOptions) (string, time.Time, error)
 
-	Update(token string, paste models.Paste) (models.Paste, error)
+	// empty content and userTTL == 0 keep current values
+	Update(token, id string, content []byte, userTTL time.Duration, opts UpdateOptions) (models.Paste, error)
 
-	Delete(token, id string) (models.Paste, error)
-	CleanExpired() error
+	// either token or deleteKey of an anonymous paste is needed,
+	// match is same as UpdateOptions.Match
+	Delete(token, deleteKey, id string, match []string) (models.Paste, error)
+	// removes at most limit expired pastes, returns how many were removed
+	CleanExpired(limit int) (int64, error)
+	// removes blobs no paste refers to and older than grace,
+	// these are left behind by failed deletes or crashes
+	CleanOrphans(grace time.Duration) (int64, error)
+	// moves content kept in the database by older versions to blob storage
+	MigrateContent() error
+	// RotateKeys rewraps data keys with the active master key and encrypts
+	// unencrypted blobs, batch by batch, returns how many blobs changed
+	RotateKeys(batch int) (int64, error)
 
-	CreateToken(token string) (string, error)
+	CreateToken(token string, opts TokenOptions) (string, error)
+	ListTokens(token string) ([]models.Token, error)
+	// toRevokeToken is either a whole token or its prefix
 	RevokeToken(accessToken, toRevokeToken string) error
 
 	TTL() time.Duration
@@ -42,17 +91,87 @@ type Service interface {
 type Options struct {
 	TTL   time.Duration
 	Limit uint
+	// smaller contents are stored uncompressed, 0 disables compression
+	CompressThreshold int
+	// signs share links, links die with it
+	ShareSecret []byte
+}
+
+type TokenOptions struct {
+	Name string
+	// empty scopes means same scopes as token
+	Scopes models.Scopes
+	// TTL == 0 means same expiry as token
+	TTL time.Duration
+}
+
+type CreateOptions struct {
+	BurnAfterRead bool
+	MaxViews      uint
+	// content is an opaque envelope, see internal/envelope
+	Encrypted bool
+	// empty means no password
+	Password string
+	// empty means public
+	Visibility models.Visibility
+	// empty means detected from filename or name and content
+	ContentType string
+	// name of uploaded file, only base name is kept
+	Filename string
+}
+
+type UpdateOptions struct {
+	// empty means detected again when content changes, kept otherwise
+	ContentType string
+	// ETags paste must have one of, nil means any
+	Match []string
+}
+
+type GetOptions struct {
+	// encodings caller can handle, content in one of them is not decompressed
+	Encodings []string
+	// needed for password protected pastes
+	Password string
+	// share link value, see Share
+	Share string
+	// Revision == 0 means current one, reading old ones counts as a read too
+	Revision uint
+	// validators of a cached copy, if it's still fresh Get fails with
+	// ErrNotModified and returns paste without content, the read is not
+	// counted then. ModifiedSince is ignored when NoneMatch is set
+	NoneMatch     []string
+	ModifiedSince time.Time
+	// Ranges picks parts of content to read once paste is known, before the
+	// read is counted, nil ranges mean all of it. Content is then those
+	// parts one after another, decompressed whatever Encodings are
+	Ranges func(paste models.Paste) ([]Range, error)
+}
+
+// Range is bytes from Start up to End, not including it
+type Range struct {
+	Start, End int64
+}
+
+type ShareOptions struct {
+	// TTL == 0 means a day
+	TTL time.Duration
+	// MaxUses == 0 means unlimited
+	MaxUses uint
 }
 
 type concreteService struct {
 	pasteRepository paste.Repository
 	tokenRepository token.Repository
+	blobRepository  blob.Repository
+	keyring         keyring.Keyring
+
+	attempts *attempts
 
 	options Options
 }
 
-func New(pasteRepository paste.Repository, tokenRepository token.Repository, options Options) Service {
-	return &concreteService{pasteRepository, tokenRepository, options}
+func New(pasteRepository paste.Repository, tokenRepository token.Repository, blobRepository blob.Repository, keyring keyring.Keyring, options Options) Service {
+	return &concreteService{pasteRepository, tokenRepository, blobRepository, keyring, newAttempts(), options}
 }
 
 func (c *concreteService) TTL() time.Duration {
@@ -63,18 +182,214 @@ func (c *concreteService) Limit() uint {
 	return c.options.Limit
 }
 
-func (c *concreteService) CleanExpired() error {
-	return c.pasteRepository.CleanExpired()
+func (c *concreteService) CleanExpired(limit int) (int64, error) {
+	// blobs are shared, unused ones go away in CleanOrphans
+	pastes, err := c.pasteRepository.CleanExpired(limit)
+	if err != nil {
+		return int64(len(pastes)), err
+	}
+
+	_, err = c.pasteRepository.CleanShares(limit)
+
+	return int64(len(pastes)), err
 }
 
-// TODO: (regular) content limit does not apply to named
-// NOTE: CreatePersistent allows TTL == 0
-func (c *concreteService) CreatePersistent(token string, name string, content []byte, userTTL time.Duration) (models.Paste, error) {
-	exists, err := c.tokenRepository.Exists(token)
-	if !exists {
-		return models.Paste{}, ErrUnauthorized
+// blobKey is shape of storage keys, sha256 of content, encrypted blobs
+// have a nonce after it, see models.Blob.StorageKey. Random 16 byte keys
+// are from before deduplication, MigrateBlobs leaves them behind
+var blobKey = regexp.MustCompile(`^([0-9a-f]{64}(\.[0-9A-Za-z_-]+)?|[0-9a-f]{32})$`)
+
+func (c *concreteService) CleanOrphans(grace time.Duration) (int64, error) {
+	var (
+		removed int64
+		batch   []string
+	)
+
+	// young blobs may belong to a paste being created right now
+	before := time.Now().Add(-grace)
+
+	for {
+		blobs, err := c.pasteRepository.DeleteUnusedBlobs(before, 100)
+		if err != nil {
+			return removed, err
+		}
+
+		// objects go after rows are committed, storage may be slow and
+		// database must not wait for it
+		keys := make([]string, len(blobs))
+		for i, blob := range blobs {
+			keys[i] = blob.StorageKey()
+		}
+
+		// same content could be stored again meanwhile, under the same key
+		// when it's not encrypted
+		used, err := c.pasteRepository.UsedBlobKeys(keys)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, key := range keys {
+			if slices.Contains(used, key) {
+				continue
+			}
+
+			// failed ones are still orphans, walk below or next run gets them
+			if err := c.blobRepository.Delete(key); err != nil {
+				slog.Warn("failed to delete unused blob", "key", key, "err", err)
+				continue
+			}
+
+			removed++
+		}
+
+		if len(blobs) < 100 {
+			break
+		}
+	}
+
+	flush := func() error {
+		used, err := c.pasteRepository.UsedBlobKeys(batch)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range batch {
+			if slices.Contains(used, key) {
+				continue
+			}
+
+			if err := c.blobRepository.Delete(key); err != nil {
+				return err
+			}
+
+			removed++
+		}
+
+		batch = batch[:0]
+
+		return nil
+	}
+
+	// objects without a blob row: failed creates and pre-deduplication leftovers
+	err := c.blobRepository.Walk(func(key string, modified time.Time) error {
+		// storage may be shared, others' objects aren't touched
+		if modified.After(before) || !blobKey.MatchString(key) {
+			return nil
+		}
+
+		batch = append(batch, key)
+		if len(batch) < 500 {
+			return nil
+		}
+
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+
+	return removed, err
+}
+
+func (c *concreteService) MigrateContent() error {
+	if err := c.pasteRepository.MigrateContent(c.store); err != nil {
+		return err
+	}
+
+	return c.pasteRepository.MigrateBlobs(func(paste models.Paste) (models.Blob, error) {
+		content, err := c.blobRepository.Get(paste.BlobKey)
+		if err != nil {
+			if errors.Is(err, blob.ErrNotFound) {
+				slog.Warn("paste content is lost", "id", paste.ID, "key", paste.BlobKey)
+				return models.Blob{Digest: paste.BlobKey, Size: paste.Size}, nil
+			}
+
+			return models.Blob{}, err
+		}
+
+		// old object is left for CleanOrphans
+		return c.store(content)
+	})
+}
+
+func (c *concreteService) RotateKeys(batch int) (int64, error) {
+	active := c.keyring.Active()
+	if active == "" {
+		return 0, ErrInvalidRequest
+	}
+
+	var (
+		rotated int64
+		after   string
+	)
+
+	for {
+		blobs, err := c.pasteRepository.StaleBlobs(active, after, batch)
+		if err != nil {
+			return rotated, err
+		}
+
+		if len(blobs) == 0 {
+			return rotated, nil
+		}
+
+		for _, b := range blobs {
+			after = b.Digest
+
+			rekeyed, err := c.rekey(b)
+			if err != nil {
+				if errors.Is(err, blob.ErrNotFound) {
+					slog.Warn("blob content is lost", "digest", b.Digest)
+					continue
+				}
+
+				return rotated, fmt.Errorf("blob %v: %w", b.Digest, err)
+			}
+
+			err = c.pasteRepository.RekeyBlob(b, rekeyed)
+			if err != nil {
+				// blob was removed meanwhile, its new object is an orphan now
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				}
+
+				return rotated, err
+			}
+
+			rotated++
+		}
+
+		slog.Info("rotated blob keys", "count", rotated)
+	}
+}
+
+// rekey puts b under the active master key, only encryption needs a new object
+func (c *concreteService) rekey(b models.Blob) (models.Blob, error) {
+	if b.KeyID != "" {
+		wrapped, err := c.keyring.Rewrap(b.KeyID, b.WrappedKey)
+		if err != nil {
+			return models.Blob{}, err
+		}
+
+		b.KeyID = c.keyring.Active()
+		b.WrappedKey = wrapped
+
+		return b, nil
 	}
 
+	stored, err := c.blobRepository.Get(b.StorageKey())
+	if err != nil {
+		return models.Blob{}, err
+	}
+
+	// plaintext object stays for readers that are in flight, CleanOrphans takes it
+	return c.seal(b, stored)
+}
+
+// TODO: (regular) content limit does not apply to named
+// NOTE: CreatePersistent allows TTL == 0
+func (c *concreteService) CreatePersistent(token string, name string, content []byte, userTTL time.Duration, opts CreateOptions) (models.Paste, error) {
+	t, err := c.authorize(token, models.ScopePasteCreate)
 	if err != nil {
 		return models.Paste{}, err
 	}
@@ -88,38 +403,44 @@ func (c *concreteService) CreatePersistent(token string, name string, content []
 		return models.Paste{}, ErrInvalidRequest
 	}
 
+	// reads take name@revision, such paste couldn't be read
+	if strings.Contains(name, "@") {
+		return models.Paste{}, ErrInvalidRequest
+	}
+
 	expires := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if userTTL > 0 {
 		expires = time.Now().Add(userTTL)
 	}
 
 	paste := models.Paste{
-		ID:           name,
-		Content:      content,
-		IsPersistent: true,
-		ExpiredAt:    expires,
-	}
-
-	paste, err = c.pasteRepository.Create(paste)
-	if err != nil {
-		if errors.Is(err, gorm.ErrDuplicatedKey) {
-			err = ErrExists
-		}
-
-		return models.Paste{}, err
+		ID:            name,
+		Content:       content,
+		IsPersistent:  true,
+		ExpiredAt:     expires,
+		BurnAfterRead: opts.BurnAfterRead,
+		MaxViews:      opts.MaxViews,
+		Encrypted:     opts.Encrypted,
+		Visibility:    opts.Visibility,
+		ContentType:   opts.ContentType,
+		Filename:      opts.Filename,
+		TokenID:       t.Prefix,
 	}
 
-	return paste, nil
+	return c.create(t, paste, opts.Password)
 }
 
-func (c *concreteService) CreateRegular(token string, content []byte, userTTL time.Duration) (models.Paste, error) {
-	authorized, err := c.tokenRepository.Exists(token)
-	if err != nil {
-		return models.Paste{}, err
-	}
+func (c *concreteService) CreateRegular(token string, content []byte, userTTL time.Duration, opts CreateOptions) (models.Paste, error) {
+	var t models.Token
 
-	if token != "" && !authorized {
-		return models.Paste{}, ErrUnauthorized
+	authorized := token != ""
+	if authorized {
+		var err error
+
+		t, err = c.authorize(token, models.ScopePasteCreate)
+		if err != nil {
+			return models.Paste{}, err
+		}
 	}
 
 	if len(content) > int(c.options.Limit) && !authorized {
@@ -143,12 +464,86 @@ func (c *concreteService) CreateRegular(token string, content []byte, userTTL ti
 	}
 
 	paste := models.Paste{
-		ID:        nanoid.Must(8),
-		Content:   content,
-		ExpiredAt: time.Now().Add(ttl),
+		ID:            nanoid.Must(8),
+		Content:       content,
+		ExpiredAt:     time.Now().Add(ttl),
+		BurnAfterRead: opts.BurnAfterRead,
+		MaxViews:      opts.MaxViews,
+		Encrypted:     opts.Encrypted,
+		Visibility:    opts.Visibility,
+		ContentType:   opts.ContentType,
+		Filename:      opts.Filename,
+		TokenID:       t.Prefix,
 	}
 
-	paste, err = c.pasteRepository.Create(paste)
+	// anonymous users have no token to delete paste with
+	var deleteKey string
+	if !authorized {
+		deleteKey = nanoid.Must(24)
+		paste.DeleteKeyHash = hashDeleteKey(deleteKey)
+	}
+
+	paste, err := c.create(t, paste, opts.Password)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	paste.DeleteKey = deleteKey
+
+	return paste, nil
+}
+
+// create stores paste.Content as a blob, then paste itself, token is
+// the one creating it, zero for anonymous pastes
+func (c *concreteService) create(token models.Token, paste models.Paste, password string) (models.Paste, error) {
+	content := paste.Content
+
+	if paste.Visibility == "" {
+		paste.Visibility = models.VisibilityPublic
+	}
+
+	paste.Revision = 1
+	paste.ModifiedAt = time.Now()
+	paste.Filename = cleanFilename(paste.Filename)
+
+	name := paste.ID
+	if paste.Filename != "" {
+		name = paste.Filename
+	}
+
+	paste.ContentType = detectType(paste.ContentType, name, content)
+
+	// nobody but admins could ever read it
+	if paste.Visibility == models.VisibilityPrivate && paste.TokenID == "" {
+		return models.Paste{}, ErrInvalidRequest
+	}
+
+	// token couldn't read it back, e.g. one made before paste:read
+	if !mayRead(token, paste) {
+		return models.Paste{}, ErrForbidden
+	}
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			// longer than 72 bytes, bcrypt would silently cut it
+			return models.Paste{}, ErrInvalidRequest
+		}
+
+		paste.PasswordHash = hash
+	}
+
+	blob, err := c.store(content)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	paste.BlobKey = blob.Digest
+	paste.Size = blob.Size
+	paste.Encoding = blob.Encoding
+	paste.KeyID = blob.KeyID
+
+	paste, err = c.pasteRepository.Create(paste, blob)
 	if err != nil {
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
 			err = ErrExists
@@ -157,41 +552,109 @@ func (c *concreteService) CreateRegular(token string, content []byte, userTTL ti
 		return models.Paste{}, err
 	}
 
+	paste.Content = content
+	paste.Encoding = models.EncodingIdentity
+
 	return paste, nil
 }
 
-func (c *concreteService) CreateToken(token string) (string, error) {
-	exists, err := c.tokenRepository.Exists(token)
-	if !exists {
-		return "", ErrUnauthorized
-	}
-
+func (c *concreteService) CreateToken(token string, opts TokenOptions) (string, error) {
+	t, err := c.authorize(token, models.ScopeTokenAdmin)
 	if err != nil {
 		return "", err
 	}
 
-	nt, err := c.tokenRepository.Create(models.Token{Token: nanoid.Must(32)})
+	if opts.TTL < 0 {
+		return "", ErrInvalidRequest
+	}
+
+	scopes := opts.Scopes
+	if len(scopes) == 0 {
+		scopes = t.Scopes
+	}
+
+	// token can't mint a token with more rights than it has
+	if !t.Scopes.Contains(scopes) {
+		return "", ErrForbidden
+	}
+
+	// nor one that outlives it
+	expires := t.ExpiresAt
+	if opts.TTL > 0 {
+		e := time.Now().Add(opts.TTL)
+		if expires != nil && e.After(*expires) {
+			return "", ErrForbidden
+		}
+
+		expires = &e
+	}
+
+	// only place where the secret is known, repository keeps a hash
+	secret := nanoid.Must(32)
+
+	_, err = c.tokenRepository.Create(secret, models.Token{
+		Name:      opts.Name,
+		Scopes:    scopes,
+		ExpiresAt: expires,
+	})
 	if err != nil {
 		return "", err
 	}
 
-	return nt.Token, nil
+	return secret, nil
+}
+
+func (c *concreteService) ListTokens(token string) ([]models.Token, error) {
+	if _, err := c.authorize(token, models.ScopeTokenAdmin); err != nil {
+		return nil, err
+	}
+
+	return c.tokenRepository.List()
 }
 
-func (c *concreteService) Delete(token string, id string) (models.Paste, error) {
-	exists, err := c.tokenRepository.Exists(token)
-	if !exists {
-		return models.Paste{}, ErrUnauthorized
+func (c *concreteService) Delete(token, deleteKey, id string, match []string) (models.Paste, error) {
+	var t models.Token
+
+	if token != "" || deleteKey == "" {
+		var err error
+
+		t, err = c.authorize(token, models.ScopePasteDelete)
+		if err != nil {
+			return models.Paste{}, err
+		}
 	}
 
+	paste, err := c.pasteRepository.GetByID(id)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Paste{}, ErrNotFound
+		}
+
 		return models.Paste{}, err
 	}
 
-	paste, err := c.pasteRepository.Delete(id)
+	if t.Prefix != "" {
+		if !owns(t, paste) {
+			return models.Paste{}, ErrForbidden
+		}
+	} else if len(paste.DeleteKeyHash) == 0 || subtle.ConstantTimeCompare(paste.DeleteKeyHash, hashDeleteKey(deleteKey)) != 1 {
+		return models.Paste{}, ErrForbidden
+	}
+
+	version, err := matchVersion(paste, match)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	paste, err = c.pasteRepository.Delete(id, version)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			err = ErrNotFound
+
+			// changed after it was checked
+			if version != nil {
+				err = ErrPreconditionFailed
+			}
 		}
 
 		return models.Paste{}, err
@@ -200,30 +663,300 @@ func (c *concreteService) Delete(token string, id string) (models.Paste, error)
 	return paste, nil
 }
 
-func (c *concreteService) Get(id string) (models.Paste, error) {
+func (c *concreteService) Peek(token, id, share string) (models.Paste, error) {
+	paste, _, err := c.peek(token, id, share)
+
+	return paste, err
+}
+
+func (c *concreteService) Counted(token, id, share string) (bool, error) {
+	paste, link, err := c.peek(token, id, share)
+	if err != nil {
+		return false, err
+	}
+
+	return paste.Counted() || link != nil && link.maxUses > 0, nil
+}
+
+// peek also returns share link if paste is only readable with it
+func (c *concreteService) peek(token, id, share string) (models.Paste, *shareLink, error) {
 	paste, err := c.pasteRepository.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Paste{}, nil, ErrNotFound
+		}
+
+		return models.Paste{}, nil, err
+	}
+
+	// reaper runs periodically, so expired rows may still be around
+	if expired(paste) {
+		return models.Paste{}, nil, ErrNotFound
+	}
+
+	if c.canRead(token, paste) {
+		return paste, nil, nil
+	}
+
+	if link, ok := c.parseShare(paste, share); ok {
+		return paste, &link, nil
+	}
+
+	// not ErrUnauthorized, that would tell private paste exists
+	return models.Paste{}, nil, ErrNotFound
+}
+
+func (c *concreteService) Get(token, id string, opts GetOptions) (models.Paste, error) {
+	paste, revision, link, err := c.lookup(token, id, opts)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	// counted reads are never cached, see notModified
+	if !paste.BurnAfterRead && paste.MaxViews == 0 && notModified(atRevision(paste, revision), opts) {
+		return atRevision(paste, revision), ErrNotModified
+	}
+
+	var ranges []Range
+	if opts.Ranges != nil {
+		ranges, err = opts.Ranges(atRevision(paste, revision))
+		if err != nil {
+			return models.Paste{}, err
+		}
+	}
+
+	if link != nil && link.maxUses > 0 {
+		if err := c.pasteRepository.UseShare(link.nonce); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return models.Paste{}, ErrNotFound
+			}
+
+			return models.Paste{}, err
+		}
+	}
+
+	if paste.BurnAfterRead {
+		paste, err = c.pasteRepository.Take(id)
+	} else {
+		paste, err = c.pasteRepository.View(id)
+	}
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// someone else got the last read
 			return models.Paste{}, ErrNotFound
 		}
 
 		return models.Paste{}, err
 	}
 
+	paste = atRevision(paste, revision)
+
+	if ranges != nil {
+		paste.Content, err = c.loadRanges(paste.BlobKey, ranges)
+		if err != nil {
+			return models.Paste{}, err
+		}
+
+		paste.Encoding = models.EncodingIdentity
+
+		return paste, nil
+	}
+
+	paste.Content, paste.Encoding, err = c.load(paste.BlobKey)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	if slices.Contains(opts.Encodings, paste.Encoding) {
+		return paste, nil
+	}
+
+	paste.Content, err = decompress(paste.Content, paste.Encoding)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	paste.Encoding = models.EncodingIdentity
+
 	return paste, nil
 }
 
-func (c *concreteService) RevokeToken(accessToken string, toRevokeToken string) error {
-	exists, err := c.tokenRepository.Exists(accessToken)
-	if !exists {
-		return ErrUnauthorized
+func (c *concreteService) Stat(token, id string, opts GetOptions) (models.Paste, error) {
+	paste, revision, _, err := c.lookup(token, id, opts)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	paste = atRevision(paste, revision)
+
+	if !paste.BurnAfterRead && paste.MaxViews == 0 && notModified(paste, opts) {
+		return paste, ErrNotModified
+	}
+
+	return paste, nil
+}
+
+// lookup is everything Get does before the read, revision is nil
+// for current one
+func (c *concreteService) lookup(token, id string, opts GetOptions) (models.Paste, *models.Revision, *shareLink, error) {
+	paste, link, err := c.peek(token, id, opts.Share)
+	if err != nil {
+		return models.Paste{}, nil, nil, err
+	}
+
+	// checked before the read is counted, wrong guesses must not burn paste
+	if err := c.checkPassword(paste, opts.Password); err != nil {
+		return models.Paste{}, nil, nil, err
+	}
+
+	// looked up before the read, Take removes revisions with paste
+	var revision *models.Revision
+	if opts.Revision != 0 && opts.Revision != max(paste.Revision, 1) {
+		r, err := c.pasteRepository.GetRevision(id, opts.Revision)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return models.Paste{}, nil, nil, ErrNotFound
+			}
+
+			return models.Paste{}, nil, nil, err
+		}
+
+		revision = &r
+	}
+
+	return paste, revision, link, nil
+}
+
+// atRevision is paste with content of revision, if there's one
+func atRevision(paste models.Paste, revision *models.Revision) models.Paste {
+	if revision != nil {
+		paste.Revision = revision.Number
+		paste.BlobKey = revision.BlobKey
+		paste.Size = revision.Size
+		paste.ModifiedAt = revision.CreatedAt
+		paste.ContentType = revision.ContentType
+	}
+
+	return paste
+}
+
+// notModified compares paste with validators in opts like HTTP does,
+// Last-Modified has only seconds
+func notModified(paste models.Paste, opts GetOptions) bool {
+	if opts.NoneMatch != nil {
+		return slices.Contains(opts.NoneMatch, "*") || slices.ContainsFunc(opts.NoneMatch, paste.HasETag)
+	}
+
+	modified := paste.LastModified()
+	if opts.ModifiedSince.IsZero() || modified.IsZero() {
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(opts.ModifiedSince)
+}
+
+func (c *concreteService) Revisions(token, id string, opts GetOptions) ([]models.Revision, error) {
+	paste, _, err := c.peek(token, id, opts.Share)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkPassword(paste, opts.Password); err != nil {
+		return nil, err
+	}
+
+	revisions, err := c.pasteRepository.Revisions(id)
+	if err != nil {
+		return nil, err
 	}
 
+	return append(revisions, models.Revision{
+		PasteID:     paste.ID,
+		Number:      max(paste.Revision, 1),
+		BlobKey:     paste.BlobKey,
+		Size:        paste.Size,
+		Encoding:    paste.Encoding,
+		KeyID:       paste.KeyID,
+		ContentType: paste.ContentType,
+		CreatedAt:   paste.LastModified(),
+	}), nil
+}
+
+func (c *concreteService) Share(token, id string, opts ShareOptions) (string, time.Time, error) {
+	if token == "" {
+		return "", time.Time{}, ErrUnauthorized
+	}
+
+	t, err := c.tokenRepository.Get(token)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", time.Time{}, ErrUnauthorized
+		}
+
+		return "", time.Time{}, err
+	}
+
+	paste, err := c.pasteRepository.GetByID(id)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", time.Time{}, ErrNotFound
+		}
+
+		return "", time.Time{}, err
+	}
+
+	if expired(paste) || !mayRead(t, paste) {
+		return "", time.Time{}, ErrNotFound
+	}
+
+	// admins read everything anyway, even without paste:read
+	canShare := t.Scopes.Has(models.ScopeTokenAdmin) || t.Scopes.Has(models.ScopePasteRead) && owns(t, paste)
+	if !canShare {
+		return "", time.Time{}, ErrForbidden
+	}
+
+	if opts.TTL < 0 {
+		return "", time.Time{}, ErrInvalidRequest
+	}
+
+	if opts.TTL == 0 {
+		opts.TTL = time.Hour * 24
+	}
+
+	link := shareLink{
+		expires: time.Now().Add(opts.TTL).Truncate(time.Second),
+		maxUses: opts.MaxUses,
+		nonce:   nanoid.Must(12),
+	}
+
+	// only limited links need to be counted, others are just signed
+	if link.maxUses > 0 {
+		err := c.pasteRepository.CreateShare(models.Share{
+			Nonce:     link.nonce,
+			PasteID:   paste.ID,
+			MaxUses:   link.maxUses,
+			ExpiresAt: link.expires,
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+
+	return c.signShare(paste, link), link.expires, nil
+}
+
+func (c *concreteService) RevokeToken(accessToken string, toRevokeToken string) error {
+	if _, err := c.authorize(accessToken, models.ScopeTokenAdmin); err != nil {
 		return err
 	}
 
-	err = c.tokenRepository.Delete(toRevokeToken)
+	prefix := toRevokeToken
+	if t, err := c.tokenRepository.Get(toRevokeToken); err == nil {
+		prefix = t.Prefix
+	}
+
+	err := c.tokenRepository.Delete(prefix)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return ErrNotFound
@@ -235,20 +968,78 @@ func (c *concreteService) RevokeToken(accessToken string, toRevokeToken string)
 	return nil
 }
 
-func (c *concreteService) Update(token string, paste models.Paste) (models.Paste, error) {
-	exists, err := c.tokenRepository.Exists(token)
-	if !exists {
-		return models.Paste{}, ErrUnauthorized
+func (c *concreteService) Update(token, id string, content []byte, userTTL time.Duration, opts UpdateOptions) (models.Paste, error) {
+	t, err := c.authorize(token, models.ScopePasteUpdate)
+	if err != nil {
+		return models.Paste{}, err
 	}
 
+	// not Get, reading for update must not burn the paste
+	paste, err := c.pasteRepository.GetByID(id)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Paste{}, ErrNotFound
+		}
+
 		return models.Paste{}, err
 	}
 
-	paste, err = c.pasteRepository.Update(paste)
+	if expired(paste) {
+		return models.Paste{}, ErrNotFound
+	}
+
+	if !owns(t, paste) {
+		return models.Paste{}, ErrForbidden
+	}
+
+	version, err := matchVersion(paste, opts.Match)
+	if err != nil {
+		return models.Paste{}, err
+	}
+
+	var blob models.Blob
+
+	if len(content) > 0 {
+		blob, err = c.store(content)
+		if err != nil {
+			return models.Paste{}, err
+		}
+
+		paste.BlobKey = blob.Digest
+		paste.Size = blob.Size
+		paste.Encoding = blob.Encoding
+		paste.KeyID = blob.KeyID
+
+		name := paste.ID
+		if paste.Filename != "" {
+			name = paste.Filename
+		}
+
+		paste.ContentType = detectType(opts.ContentType, name, content)
+		paste.ModifiedAt = nextModified(paste)
+	} else if contentType := parseType(opts.ContentType); contentType != "" {
+		// served type changes, caches must not keep the old one
+		paste.ContentType = contentType
+		paste.ModifiedAt = nextModified(paste)
+	}
+
+	if userTTL > 0 {
+		paste.ExpiredAt = time.Now().Add(userTTL)
+	}
+
+	paste, err = c.pasteRepository.Update(paste, blob, version)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			err = ErrNotFound
+
+			if version != nil {
+				err = ErrPreconditionFailed
+			}
+		}
+
+		// someone else updated it at the same time
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			err = ErrExists
 		}
 
 		return models.Paste{}, err
@@ -256,3 +1047,242 @@ func (c *concreteService) Update(token string, paste models.Paste) (models.Paste
 
 	return paste, nil
 }
+
+// nextModified is now for changed paste, Last-Modified has only seconds,
+// change within the same second as previous one must still look newer to caches
+func nextModified(paste models.Paste) time.Time {
+	next := paste.LastModified().Truncate(time.Second).Add(time.Second)
+
+	now := time.Now()
+	if now.Before(next) {
+		return next
+	}
+
+	return now
+}
+
+// matchVersion checks paste against ETags in match and returns its
+// version to be checked again while it's changed, nil when match is nil
+func matchVersion(paste models.Paste, match []string) (*models.Paste, error) {
+	if match == nil {
+		return nil, nil
+	}
+
+	if !slices.ContainsFunc(match, paste.HasETag) {
+		return nil, ErrPreconditionFailed
+	}
+
+	return &paste, nil
+}
+
+func (c *concreteService) authorize(token string, scope models.Scope) (models.Token, error) {
+	if token == "" {
+		return models.Token{}, ErrUnauthorized
+	}
+
+	t, err := c.tokenRepository.Get(token)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Token{}, ErrUnauthorized
+		}
+
+		return models.Token{}, err
+	}
+
+	if !t.Scopes.Has(scope) {
+		return models.Token{}, ErrForbidden
+	}
+
+	return t, nil
+}
+
+// store uploads content unless a blob with same digest exists, compressing
+// and encrypting it when enabled, returned blob is not referenced yet
+func (c *concreteService) store(content []byte) (models.Blob, error) {
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	blob, exists, err := c.pasteRepository.TouchBlob(digest)
+	if err != nil {
+		return models.Blob{}, err
+	}
+
+	if exists {
+		return blob, nil
+	}
+
+	stored, encoding := compress(content, c.options.CompressThreshold)
+	blob = models.Blob{Digest: digest, Size: int64(len(content)), Encoding: encoding}
+
+	if c.keyring.Active() != "" {
+		return c.seal(blob, stored)
+	}
+
+	if err := c.blobRepository.Put(digest, stored); err != nil {
+		return models.Blob{}, err
+	}
+
+	return blob, nil
+}
+
+// seal encrypts stored bytes of blob into a new object, every encrypted
+// object is unique, so concurrent writers never overwrite each other's
+func (c *concreteService) seal(blob models.Blob, stored []byte) (models.Blob, error) {
+	keyID, wrapped, sealed, err := c.keyring.Seal(stored, []byte(blob.Digest))
+	if err != nil {
+		return models.Blob{}, err
+	}
+
+	object := blob.Digest + "." + nanoid.Must(12)
+	if err := c.blobRepository.Put(object, sealed); err != nil {
+		return models.Blob{}, err
+	}
+
+	blob.Object = object
+	blob.KeyID = keyID
+	blob.WrappedKey = wrapped
+
+	return blob, nil
+}
+
+// load returns stored bytes of blob, decrypted but still compressed, and their encoding
+func (c *concreteService) load(digest string) ([]byte, string, error) {
+	blob, err := c.pasteRepository.GetBlob(digest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stored, err := c.read(blob)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return stored, blob.Encoding, nil
+}
+
+// read returns stored content of blob, decrypted, but still encoded
+func (c *concreteService) read(blob models.Blob) ([]byte, error) {
+	stored, err := c.blobRepository.Get(blob.StorageKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if blob.KeyID == "" {
+		return stored, nil
+	}
+
+	return c.keyring.Open(blob.KeyID, blob.WrappedKey, stored, []byte(blob.Digest))
+}
+
+// loadRanges reads only ranges of content from storage when it's kept there
+// as it is, compressed or encrypted content has to be read whole
+func (c *concreteService) loadRanges(digest string, ranges []Range) ([]byte, error) {
+	blob, err := c.pasteRepository.GetBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+
+	if blob.KeyID == "" && blob.Encoding == models.EncodingIdentity {
+		for _, r := range ranges {
+			part, err := c.blobRepository.GetRange(blob.StorageKey(), r.Start, r.End-r.Start)
+			if err != nil {
+				return nil, err
+			}
+
+			content = append(content, part...)
+		}
+
+		return content, nil
+	}
+
+	stored, err := c.read(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	whole, err := decompress(stored, blob.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	// content could change since ranges were picked
+	size := int64(len(whole))
+	for _, r := range ranges {
+		content = append(content, whole[min(r.Start, size):min(r.End, size)]...)
+	}
+
+	return content, nil
+}
+
+func (c *concreteService) canRead(token string, paste models.Paste) bool {
+	if paste.Visibility != models.VisibilityPrivate {
+		return true
+	}
+
+	if token == "" {
+		return false
+	}
+
+	t, err := c.tokenRepository.Get(token)
+	if err != nil {
+		return false
+	}
+
+	return mayRead(t, paste)
+}
+
+func mayRead(token models.Token, paste models.Paste) bool {
+	if paste.Visibility != models.VisibilityPrivate || token.Scopes.Has(models.ScopeTokenAdmin) {
+		return true
+	}
+
+	return token.Scopes.Has(models.ScopePasteRead) && owns(token, paste)
+}
+
+func (c *concreteService) checkPassword(paste models.Paste, password string) error {
+	if len(paste.PasswordHash) == 0 {
+		return nil
+	}
+
+	if password == "" {
+		return ErrUnauthorized
+	}
+
+	if !c.attempts.reserve(paste.ID) {
+		return ErrTooManyAttempts
+	}
+
+	if bcrypt.CompareHashAndPassword(paste.PasswordHash, []byte(password)) != nil {
+		return ErrUnauthorized
+	}
+
+	c.attempts.refund(paste.ID)
+
+	return nil
+}
+
+// pastes without owner, made anonymously or before ownership, are admin only
+func owns(token models.Token, paste models.Paste) bool {
+	if token.Scopes.Has(models.ScopeTokenAdmin) {
+		return true
+	}
+
+	return paste.TokenID != "" && paste.TokenID == token.Prefix
+}
+
+func hashDeleteKey(key string) []byte {
+	// key is random enough for plain sha256
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// exhausted pastes are treated exactly like expired ones
+func expired(paste models.Paste) bool {
+	if paste.MaxViews > 0 && paste.Views >= paste.MaxViews {
+		return true
+	}
+
+	return time.Now().After(paste.ExpiredAt)
+}
@@ -0,0 +1,75 @@
+package paste
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xbt573/barkpaste/internal/models"
+)
+
+// shareLink is <expires>.<max uses>.<nonce>.<signature> in ?share=,
+// signature also covers paste ID and creation time, so a named paste
+// created again doesn't inherit links of the old one
+type shareLink struct {
+	expires time.Time
+	maxUses uint
+	nonce   string
+}
+
+func (c *concreteService) signShare(paste models.Paste, link shareLink) string {
+	payload := fmt.Sprintf("%v.%v.%v", link.expires.Unix(), link.maxUses, link.nonce)
+
+	return payload + "." + c.shareSignature(paste, payload)
+}
+
+// parseShare reports whether raw is a valid unexpired link to paste,
+// uses are counted elsewhere
+func (c *concreteService) parseShare(paste models.Paste, raw string) (shareLink, bool) {
+	if raw == "" || len(c.options.ShareSecret) == 0 {
+		return shareLink{}, false
+	}
+
+	i := strings.LastIndexByte(raw, '.')
+	if i < 0 {
+		return shareLink{}, false
+	}
+
+	payload, signature := raw[:i], raw[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(c.shareSignature(paste, payload))) {
+		return shareLink{}, false
+	}
+
+	fields := strings.Split(payload, ".")
+	if len(fields) != 3 {
+		return shareLink{}, false
+	}
+
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return shareLink{}, false
+	}
+
+	maxUses, err := strconv.ParseUint(fields[1], 10, 0)
+	if err != nil {
+		return shareLink{}, false
+	}
+
+	link := shareLink{time.Unix(expires, 0), uint(maxUses), fields[2]}
+	if time.Now().After(link.expires) {
+		return shareLink{}, false
+	}
+
+	return link, true
+}
+
+func (c *concreteService) shareSignature(paste models.Paste, payload string) string {
+	mac := hmac.New(sha256.New, c.options.ShareSecret)
+	fmt.Fprintf(mac, "%v\n%v\n%v", paste.ID, paste.CreatedAt.UnixMicro(), payload)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}